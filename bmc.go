@@ -30,6 +30,8 @@ const (
 
 // Main sdr flags
 const (
+	IPMI_SDR_MODAL_UPDATE_SUPPORTED           = (1 << 6)
+	IPMI_SDR_NON_MODAL_UPDATE_SUPPORTED       = (1 << 5)
 	IPMI_SDR_DELETE_SDR_SUPPORTED             = (1 << 3)
 	IPMI_SDR_PARTIAL_ADD_SDR_SUPPORTED        = (1 << 2)
 	IPMI_SDR_RESERVE_SDR_SUPPORTED            = (1 << 1)
@@ -40,14 +42,21 @@ type sdrT struct {
 	recordId        uint16
 	lun             uint8
 	sensNum         uint8
-	length          uint8
+	length          uint16
 	enabled         bool
 	eventsEnabled   bool
 	scanningEnabled bool
 	eventStatus     uint16
 	value           uint8
-	data            [64]uint8
+	data            [MAX_SDR_LENGTH]uint8
 	next            *sdrT
+
+	// The last read of the sensor failed
+	readingUnavailable bool
+
+	// Last value update sent to the MM, see sensorValuePush
+	pushed   [4]uint8
+	pushTime time.Time
 }
 
 type sdrsT struct {
@@ -63,7 +72,13 @@ type sdrsT struct {
 	sdrsLength      uint32
 	tailSdr         *sdrT
 	sdrs            *sdrT // A linked list of SDR entries.
+	partial         *sdrT // Partial add in progress
+	updateMode      bool
+	dirty           bool // Changed since last saved
 
+	// Clear SDR Repository erase waiting for the main loop
+	erasing          bool
+	eraseReservation uint16
 }
 
 type selEntryT struct {
@@ -83,6 +98,13 @@ type selT struct {
 	lastEntry     uint16
 }
 
+// A message queued for retrieval with Get Message
+type rcvMsgT struct {
+	channel uint8
+	priv    uint8
+	data    []uint8
+}
+
 type mcT struct {
 	bmcIpmb        uint8 // address of bmc
 	deviceId       uint8
@@ -97,22 +119,38 @@ type mcT struct {
 	sel            selT
 	mainSdrs       sdrsT
 	sensors        [4][255]*sensorT
+	sensorList     []*sensorT // polling order
+	chassis        chassisT
+
+	// Send/Get Message bridging state
+	bridgeSeq     uint8
+	bridgePending map[uint8]*bridgeReqT // by sequence number
+	ipmbRoutes    map[uint8]string      // ipmb address -> lan service
+	ipmbConns     map[uint8]net.Conn
+	rcvEnabled    [IPMI_MAX_CHANNELS]bool
+	rcvQueues     [IPMI_MAX_CHANNELS][]rcvMsgT
+
+	// When the MM last heard from each LC
+	cardLastSeen map[uint8]time.Time
+
+	// Device sdr repository of our own sensors
+	deviceSdrReservation uint16
+	deviceSdrChangeTime  uint32
 }
 
 var mc mcT
 
 func bmcInit() {
 
-	var sensorNum uint8
-
 	// Initialize the bmc
-	mc.bmcIpmb = 0x20
+	mc.bmcIpmb = cardIpmbAddr(chassisCardNum)
 	mc.deviceId = 0
-	mc.hasDeviceSdrs = false
+	mc.hasDeviceSdrs = true
 	mc.deviceRevision = 1
 	mc.majorFwRev = 1
 	mc.minorFwRev = 1
-	mc.deviceSupport = IPMI_DEVID_SDR_REPOSITORY_DEV |
+	mc.deviceSupport = IPMI_DEVID_CHASSIS_DEVICE |
+		IPMI_DEVID_SDR_REPOSITORY_DEV |
 		IPMI_DEVID_SENSOR_DEV
 	mc.mfgId[0] = 0
 	mc.mfgId[1] = 0
@@ -120,75 +158,52 @@ func bmcInit() {
 	mc.productId[0] = 0
 	mc.productId[1] = 0
 
-	mc.mainSdrs.flags = IPMI_SDR_RESERVE_SDR_SUPPORTED
+	mc.mainSdrs.flags = IPMI_SDR_RESERVE_SDR_SUPPORTED |
+		IPMI_SDR_DELETE_SDR_SUPPORTED |
+		IPMI_SDR_PARTIAL_ADD_SDR_SUPPORTED |
+		IPMI_SDR_GET_SDR_ALLOC_INFO_SDR_SUPPORTED |
+		IPMI_SDR_MODAL_UPDATE_SUPPORTED |
+		IPMI_SDR_NON_MODAL_UPDATE_SUPPORTED
 	mc.mainSdrs.maxSdrCount = 2000
 	mc.mainSdrs.nextFreeEntryId = 1
 
 	mc.sel.maxCount = 1000
 	mc.sel.nextEntry = 1
 
+	if simulate {
+		mc.chassis.driver = &simChassisDriver{on: true}
+		mc.chassis.identify = &simIdentifyDriver{}
+	} else {
+		mc.chassis.driver = &execChassisDriver{path: chassisScript}
+		mc.chassis.identify = newSysfsLedDriver()
+	}
+	chassisLoad()
+	bootOptsLoad()
+	sdrsLoad()
+	chassisPowerRestore()
+
+	mc.bridgePending = make(map[uint8]*bridgeReqT)
+	mc.ipmbRoutes = make(map[uint8]string)
+	mc.ipmbConns = make(map[uint8]net.Conn)
+	mc.rcvEnabled[IPMI_CHANNEL_IPMB] = true
+	mc.cardLastSeen = make(map[uint8]time.Time)
+	if chassisCardNum > 0 {
+		// The MM is always reachable over the LC link
+		mc.ipmbRoutes[cardIpmbAddr(0)] = service
+	}
+
+	// Locators for this controller and its FRU inventory
+	mcLocatorSdrAdd()
+	fruLocatorSdrAdd()
+
 	// Initially this is a simulated set of sensors.
 	// In production, a similar scheme could be used or
 	// perhaps a more dynamic scheme where the sysclass fs is
 	// scanned to gather these params.
 	if simulate {
-		var sensorName1, sensorName2, sensorName3, sensorName4 []uint8
-
-		// sensor 1 - temp
-		sensorNum = 1 + (16 * chassisCardNum)
-		sensorAdd(0x20, 0, sensorNum, 1, 1)
-		sensorName1 = append(sensorName1, '0'+chassisCardNum)
-		sensorName1 = append(sensorName1,
-			[]uint8{'D', 'J', 't', 'e', 'm', 'p'}...)
-		mainSdrAdd(0x20, 0x0001, 0x51, 1, 0x32, 0x20, 0, sensorNum,
-			3, chassisCardNum, 0x67, 0x88, 1, 1, 0xC00F,
-			0xC07F, 0x3838, 0, 1, 0, 0,
-			1, 0, 0, 0, 0, 0, 3, 0x60,
-			0xB0, 0, 0xB0, 0, 0xA0, 0x90, 0x66, 0,
-			0, 0, 0, 0, 0, 0, 0, 0xC7,
-			sensorName1)
-
-		// sensor 2 - voltage
-		sensorNum = 2 + (16 * chassisCardNum)
-		sensorAdd(0x20, 0, sensorNum, 2, 1)
-		sensorName2 = append(sensorName2, '0'+chassisCardNum)
-		sensorName2 = append(sensorName2,
-			[]uint8{'M', 'X', 'v', 'o', 'l', 't', 'a', 'g', 'e'}...)
-		mainSdrAdd(0x20, 0x0002, 0x51, 1, 0x35, 0x20, 0, sensorNum,
-			3, chassisCardNum, 0x67, 0x88, 2, 1, 0xC00F,
-			0xC07F, 0x3838, 0, 4, 0, 0,
-			1, 0, 0, 0, 0, 0, 3, 0,
-			0, 0x0D, 0x10, 0x0C, 0x0F, 0x0E, 0x0D, 0,
-			0, 0, 0, 0, 0, 0, 0, 0xCA,
-			sensorName2)
-
-		// sensor 3 - current
-		sensorNum = 3 + (16 * chassisCardNum)
-		sensorAdd(0x20, 0, sensorNum, 3, 1)
-		sensorName3 = append(sensorName3, '0'+chassisCardNum)
-		sensorName3 = append(sensorName3,
-			[]uint8{'M', 'X', 'c', 'u', 'r', 'r', 'e', 'n', 't'}...)
-		mainSdrAdd(0x20, 0x0003, 0x51, 1, 0x35, 0x20, 0, sensorNum,
-			3, chassisCardNum, 0x67, 0x88, 3, 1, 0xC00F,
-			0xC07F, 0x3838, 0, 5, 0, 0,
-			1, 0, 0, 0, 0, 0, 3, 0,
-			0, 3, 6, 5, 7, 6, 5, 0,
-			0, 0, 0, 0, 0, 0, 0, 0xCA,
-			sensorName3)
-
-		// sensor 4 - fan
-		sensorNum = 4 + (16 * chassisCardNum)
-		sensorAdd(0x20, 0, sensorNum, 4, 1)
-		sensorName4 = append(sensorName4, '0'+chassisCardNum)
-		sensorName4 = append(sensorName4,
-			[]uint8{'F', 'X', 'f', 'a', 'n', 'r', 'e', 'a', 'd'}...)
-		mainSdrAdd(0x20, 0x0004, 0x51, 1, 0x35, 0x20, 0, sensorNum,
-			3, chassisCardNum, 0x67, 0x88, 4, 1, 0xC00F,
-			0xC07F, 0x3838, 4, 0x12, 0x0A, 0,
-			1, 0, 0, 0, 0, 0, 3, 0,
-			0, 0x28, 0x50, 0x32, 0x46, 0x3C, 0, 0,
-			0, 0, 0, 0, 0, 0, 0, 0xCA,
-			sensorName4)
+		fixedSensorsAdd()
+		discreteSensorsAdd()
+		simSourcesAttach()
 
 		// Add an event log to sel for sensor 17
 		selRecord := []uint8{0x01, 0x00, 0x02, 0x00, 0x00, 0x00,
@@ -211,18 +226,65 @@ func bmcInit() {
 		//ltc4215 (hot-swap controller) ??
 		//ucd9090 (voltage/fan/temp monitor)
 		//lm75 (temp monitor)
+		hwmonSensorsAdd(hwmonRoot)
+		discreteSensorsAdd()
+	}
+}
+
+// The fixed set of sensors and their sdrs for this switch
+func fixedSensorsAdd() {
+	card := string('0' + chassisCardNum)
+
+	// Nominal, normal max/min and sensor max/min readings, then
+	// thresholds by THRESHOLD_LNC..UNR
+	fixed := []struct {
+		sensorType uint8
+		units      uint8
+		analog     [5]uint8
+		thresholds [NUM_THRESHOLDS]uint8
+		id         string
+	}{
+		{1, 1, [5]uint8{0x60, 0xb0, 0, 0xb0, 0},
+			[6]uint8{0, 0, 0, 0x66, 0x90, 0xa0}, "DJtemp"},
+		{2, 4, [5]uint8{0, 0, 0x0d, 0x10, 0x0c},
+			[6]uint8{0, 0, 0, 0x0d, 0x0e, 0x0f}, "MXvoltage"},
+		{3, 5, [5]uint8{0, 0, 3, 6, 5},
+			[6]uint8{0, 0, 0, 5, 6, 7}, "MXcurrent"},
+		{4, 0x12, [5]uint8{0, 0, 0x28, 0x50, 0x32},
+			[6]uint8{0, 0, 0, 0, 0x3c, 0x46}, "FXfanread"},
 	}
 
-	// Start ticker for sensor polling in a gofunc
-	ticker := time.NewTicker(time.Second * 3)
-	go func() {
-		for t := range ticker.C {
-			if debug {
-				fmt.Println("Tick at", t)
-			}
-			pollSensors()
+	for i, f := range fixed {
+		sensorNum := uint8(i+1) + (16 * chassisCardNum)
+		sensorAdd(mc.bmcIpmb, 0, sensorNum, f.sensorType, 1)
+		sdr := &FullSensorSdr{
+			SdrSensor: SdrSensor{OwnerId: mc.bmcIpmb, Number: sensorNum,
+				EntityId: 3, EntityInstance: chassisCardNum},
+			Init:             0x67,
+			Caps:             0x88,
+			SensorType:       f.sensorType,
+			EventReadingType: 1,
+			AssertionMask:    0xc00f,
+			DeassertionMask:  0xc07f,
+			ReadingMask:      0x3838,
+			Units2:           f.units,
+			M:                1,
+			AnalogFlags:      3,
+			NominalReading:   f.analog[0],
+			NormalMax:        f.analog[1],
+			NormalMin:        f.analog[2],
+			SensorMax:        f.analog[3],
+			SensorMin:        f.analog[4],
+			Thresholds:       f.thresholds,
+			SdrId:            sdrId(card + f.id),
 		}
-	}()
+		if f.sensorType == 4 {
+			// fan reads in hundreds of rpm
+			sdr.Units1 = 4
+			sdr.Units3 = 0x0a
+		}
+		mainSdrAdd(sdr)
+	}
 }
 
 func sensorAdd(bmc uint8, lun uint8, num uint8, stype uint8, code uint8) {
@@ -236,117 +298,94 @@ func sensorAdd(bmc uint8, lun uint8, num uint8, stype uint8, code uint8) {
 	sensor.eventStatus = 0
 	sensor.eventsEnabled = true
 	sensor.scanningEnabled = true
+	if code == THRESHOLD_EVENT_TYPE {
+		sensor.history = new(historyT)
+	}
 
 	mc.sensors[lun][num] = sensor
+	mc.sensorList = append(mc.sensorList, sensor)
 }
 
-func mainSdrAdd(bmc uint8, recordId uint16, sdrVers uint8,
-	recordType uint8, recordLength uint8, sensorOwnerId uint8,
-	sensorOwnerLun uint8, sensorNum uint8, entityId uint8,
-	entityInstance uint8, sensorInit uint8, sensorCaps uint8,
-	sensorType uint8, eventCode uint8, assLthrMask uint16,
-	deassHthrMask uint16, drStRdMask uint16, sensorUnits1 uint8,
-	sensorUnits2 uint8, sensorUnits3 uint8, linear uint8,
-	m uint8, mTol uint8, b uint8, bAcc uint8, accDir uint8,
-	rexpBexp uint8, anlogFlags uint8, nomReading uint8,
-	normMax uint8, normMin uint8, sensorMax uint8, sensorMin uint8,
-	upperNcThr uint8, upperCrThr uint8, upperNcrThr uint8,
-	lowerNrThr uint8, lowerCrThr uint8, lowerNcrThr uint8,
-	pgThrHyst uint8, ngThrHyst uint8, res1 uint8, res2 uint8,
-	oem uint8, idStrLghtCode uint8, idStr []uint8) {
-
-	var (
-		msgData []uint8
-		try     int
-	)
-
-	// Range check the list
-	if mc.mainSdrs.nextFreeEntryId >= mc.mainSdrs.maxSdrCount {
+// Add a locally built record of any type to the main sdrs, its record
+// id is assigned here.
+func mainSdrAdd(record Sdr) *sdrT {
+	data, err := record.MarshalBinary()
+	if err != nil {
+		fmt.Println("mainSdrAdd:", err)
+		return nil
+	}
+
+	// A record restored from the saved repository keeps its record id
+	if newSdr := sdrDuplicate(data); newSdr != nil {
+		record.Header().RecordId = newSdr.recordId
+		mc.mainSdrs.update(newSdr, data)
+		mainSdrPublish(newSdr)
+		return newSdr
+	}
+
+	if !mc.mainSdrs.spaceFor(uint16(len(data))) {
 		fmt.Println("mainSdrs are full!")
-		return
+		return nil
+	}
+	recordId, ok := sdrIdAlloc()
+	if !ok {
+		fmt.Println("mainSdrs are out of record ids!")
+		return nil
 	}
 
 	// Obtain and initialize new sdr entry
 	newSdr := new(sdrT)
-	newSdr.recordId = mc.mainSdrs.nextFreeEntryId
-	mc.mainSdrs.nextFreeEntryId++
-	newSdr.length = 48 + uint8(idStrLghtCode&0x1F) + 5
+	newSdr.recordId = recordId
+	record.Header().RecordId = newSdr.recordId
+	newSdr.length = uint16(len(data))
 	newSdr.enabled = true
 	newSdr.eventsEnabled = true
 	newSdr.scanningEnabled = true
-	newSdr.eventStatus = 0
-	newSdr.lun = sensorOwnerLun
-	newSdr.sensNum = sensorNum
-
-	// Serialize SDR record into newSdr's data
+	copy(newSdr.data[:], data)
 	binary.LittleEndian.PutUint16(newSdr.data[0:2], newSdr.recordId)
-	newSdr.data[2] = sdrVers
-	newSdr.data[3] = recordType
-	newSdr.data[4] = recordLength
-	newSdr.data[5] = sensorOwnerId
-	newSdr.data[6] = sensorOwnerLun
-	newSdr.data[7] = sensorNum
-	newSdr.data[8] = entityId
-	newSdr.data[9] = entityInstance
-	newSdr.data[10] = sensorInit
-	newSdr.data[11] = sensorCaps
-	newSdr.data[12] = sensorType
-	newSdr.data[13] = eventCode
-	binary.LittleEndian.PutUint16(newSdr.data[14:16], assLthrMask)
-	binary.LittleEndian.PutUint16(newSdr.data[16:18], deassHthrMask)
-	binary.LittleEndian.PutUint16(newSdr.data[18:20], drStRdMask)
-	newSdr.data[20] = sensorUnits1
-	newSdr.data[21] = sensorUnits2
-	newSdr.data[22] = sensorUnits3
-	newSdr.data[23] = linear
-	newSdr.data[24] = m
-	newSdr.data[25] = mTol
-	newSdr.data[26] = b
-	newSdr.data[27] = bAcc
-	newSdr.data[28] = accDir
-	newSdr.data[29] = rexpBexp
-	newSdr.data[30] = anlogFlags
-	newSdr.data[31] = nomReading
-	newSdr.data[32] = normMax
-	newSdr.data[33] = normMin
-	newSdr.data[34] = sensorMax
-	newSdr.data[35] = sensorMin
-	newSdr.data[36] = upperNcThr
-	newSdr.data[37] = upperCrThr
-	newSdr.data[38] = upperNcrThr
-	newSdr.data[39] = lowerNrThr
-	newSdr.data[40] = lowerCrThr
-	newSdr.data[41] = lowerNcrThr
-	newSdr.data[42] = pgThrHyst
-	newSdr.data[43] = ngThrHyst
-	newSdr.data[44] = res1
-	newSdr.data[45] = res2
-	newSdr.data[46] = oem
-	newSdr.data[47] = idStrLghtCode
-	idStrLength := idStrLghtCode & 0x1F
-	copy(newSdr.data[48:], idStr[0:idStrLength])
-
-	// Add new entry into main_sdr at the tail
-	if mc.mainSdrs.sdrs == nil {
-		mc.mainSdrs.sdrs = newSdr
-	} else {
-		mc.mainSdrs.tailSdr.next = newSdr
+	sdrKeySet(newSdr)
+
+	mainSdrLink(newSdr)
+	return newSdr
+}
+
+// Pick up thresholds, hysteresis and event masks for a local sensor.
+// Only full sensor records owned by this controller have them all.
+func sdrLocalTie(newSdr *sdrT) {
+	if sdrRecordType(newSdr) == SDR_FULL_SENSOR &&
+		newSdr.data[5] == mc.bmcIpmb && newSdr.sensNum < 255 &&
+		mc.sensors[newSdr.lun&3][newSdr.sensNum] != nil {
+		sensorSdrInit(mc.sensors[newSdr.lun&3][newSdr.sensNum], newSdr)
+		deviceSdrsChanged()
 	}
-	mc.mainSdrs.tailSdr = newSdr
-	now := time.Now()
-	nowUnix := uint32(now.Unix())
-	mc.sel.lastAddTime = nowUnix
-	mc.mainSdrs.sdrCount++
+}
+
+// A local sensor without its sdr is no longer polled
+func sdrLocalUntie(entry *sdrT) {
+	if sdrIsSensor(entry) && entry.sensNum < 255 {
+		sensor := mc.sensors[entry.lun&3][entry.sensNum]
+		if sensor != nil && sensor.sdr == entry {
+			sensor.sdr = nil
+			deviceSdrsChanged()
+		}
+	}
+}
+
+// Add new entry into main_sdr at the tail, tie it to its local sensor
+// and, if an LC, send it to the MM.
+func mainSdrLink(newSdr *sdrT) {
+	mc.mainSdrs.link(newSdr)
+	mainSdrPublish(newSdr)
+}
+
+func mainSdrPublish(newSdr *sdrT) {
+	sdrLocalTie(newSdr)
 
 	// If an LC send this new SDR to MM
 	if chassisCardNum > 0 {
-		msgData = addSdrBuildMsg(newSdr)
-		for try = 0; try < MAX_RETRIES; try++ {
-			if ipmiReqRsp(mc.mmConn, msgData, addSdrParseRsp) {
-				break
-			}
-		}
-		if try >= MAX_RETRIES {
+		if !mmReqRsp(func() []uint8 {
+			return addSdrBuildMsg(newSdr)
+		}, addSdrParseRsp) {
 			panic("ipmiClient add-sdr to MM")
 		}
 	}
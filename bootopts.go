@@ -0,0 +1,243 @@
+// Copyright 2015 Platina Systems, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style license described in the
+// LICENSE file.
+
+// Package contains IPMI 2.0 spec implementation
+package ipmigod
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// System boot option parameters
+const (
+	BOOT_OPT_SET_IN_PROGRESS    = 0
+	BOOT_OPT_SERVICE_PARTITION  = 1
+	BOOT_OPT_SERVICE_SCAN       = 2
+	BOOT_OPT_VALID_BIT_CLEARING = 3
+	BOOT_OPT_BOOT_INFO_ACK      = 4
+	BOOT_OPT_BOOT_FLAGS         = 5
+	BOOT_OPT_INITIATOR_INFO     = 6
+	BOOT_OPT_INITIATOR_MAILBOX  = 7
+	NUM_BOOT_OPTS               = 8
+
+	BOOT_OPT_PARAM_VERSION = 1
+	BOOT_MAILBOX_BLOCKS    = 5
+	BOOT_MAILBOX_BLOCK_LEN = 16
+	BOOT_FLAGS_VALID       = 0x80
+	BOOT_FLAGS_PERSISTENT  = 0x40
+	BOOT_FLAGS_TIMEOUT     = 60 * time.Second
+	BOOT_OPTS_STATE_FILE   = "bootopts.json"
+)
+
+// Data length of each parameter as set/returned on the wire
+var bootOptLengths = [NUM_BOOT_OPTS]int{1, 1, 1, 1, 2, 5, 9,
+	1 + BOOT_MAILBOX_BLOCK_LEN}
+
+// Boot option parameters kept across ipmigod restarts
+type bootOptsT struct {
+	SetInProgress    uint8
+	ServicePartition uint8
+	ServiceScan      uint8
+	ValidBitClearing uint8
+	BootInfoAck      uint8
+	BootFlags        [5]uint8
+	InitiatorInfo    [9]uint8
+	Mailbox          [BOOT_MAILBOX_BLOCKS][BOOT_MAILBOX_BLOCK_LEN]uint8
+	Locked           [NUM_BOOT_OPTS]bool
+	BootFlagsUsed    bool // a boot has powered on with the flags
+}
+
+var (
+	bootOpts       bootOptsT
+	bootFlagsTimer *time.Timer
+)
+
+func bootOptsLoad() {
+	err := stateLoad(BOOT_OPTS_STATE_FILE, &bootOpts)
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Println("bootOptsLoad:", err)
+	}
+	// A set in progress does not survive a restart
+	bootOpts.SetInProgress = 0
+	if bootOpts.BootFlags[0]&BOOT_FLAGS_VALID != 0 {
+		bootFlagsTimerStart()
+	}
+}
+
+func bootOptsSave() {
+	err := stateSave(BOOT_OPTS_STATE_FILE, &bootOpts)
+	if err != nil {
+		fmt.Println("bootOptsSave:", err)
+	}
+}
+
+func bootFlagsTimerStop() {
+	if bootFlagsTimer != nil {
+		bootFlagsTimer.Stop()
+		bootFlagsTimer = nil
+	}
+}
+
+// Valid boot flags are cleared if no chassis control command
+// arrives within 60 seconds, unless told otherwise. The main loop
+// waits on the timer, see bootFlagsExpired.
+func bootFlagsTimerStart() {
+	bootFlagsTimerStop()
+	if bootOpts.ValidBitClearing&0x10 != 0 {
+		return
+	}
+	bootFlagsTimer = time.NewTimer(BOOT_FLAGS_TIMEOUT)
+}
+
+func bootFlagsExpired() {
+	bootFlagsTimer = nil
+	if debug {
+		fmt.Println("Boot flags valid bit timed out")
+	}
+	bootOpts.BootFlags[0] &^= BOOT_FLAGS_VALID
+	bootOptsSave()
+}
+
+// Called on a system restart. A restart from a chassis control command
+// is the one the boot flags are meant for and leaves them for the
+// BIOS to consume; other restarts clear the valid bit unless the
+// valid bit clearing parameter says not to.
+func bootOptsRestart(cause uint8) {
+	var keepMask uint8
+
+	bootFlagsTimerStop()
+	switch cause {
+	case RESTART_CAUSE_CHASSIS_CONTROL:
+		return
+	case RESTART_CAUSE_PEF_RESET, RESTART_CAUSE_PEF_POWER_CYCLE:
+		keepMask = 0x01
+	case RESTART_CAUSE_POWER_BUTTON, RESTART_CAUSE_RTC_WAKEUP,
+		RESTART_CAUSE_RESTORE_ALWAYS, RESTART_CAUSE_RESTORE_PREVIOUS:
+		keepMask = 0x02
+	case RESTART_CAUSE_RESET_BUTTON, RESTART_CAUSE_SOFT_RESET:
+		keepMask = 0x04
+	case RESTART_CAUSE_WATCHDOG:
+		keepMask = 0x08
+	}
+	if bootOpts.ValidBitClearing&keepMask != 0 ||
+		bootOpts.BootFlags[0]&BOOT_FLAGS_VALID == 0 {
+		return
+	}
+	bootOpts.BootFlags[0] &^= BOOT_FLAGS_VALID
+	bootOptsSave()
+}
+
+// Called when the chassis powers on. Boot flags without the persistent
+// bit are for one boot only: the power-on that boot starts with stops
+// the valid bit timeout and leaves the flags for the BIOS to read, the
+// next power-on clears them.
+func bootOptsPowerOn() {
+	flags := bootOpts.BootFlags[0]
+	if flags&BOOT_FLAGS_VALID == 0 || flags&BOOT_FLAGS_PERSISTENT != 0 {
+		return
+	}
+	bootFlagsTimerStop()
+	if bootOpts.BootFlagsUsed {
+		bootOpts.BootFlags[0] &^= BOOT_FLAGS_VALID
+		bootOpts.BootFlagsUsed = false
+	} else {
+		bootOpts.BootFlagsUsed = true
+	}
+	bootOptsSave()
+}
+
+// Update a boot option parameter and return a completion code
+func bootOptSet(param uint8, locked bool, data []uint8) uint8 {
+	if param >= NUM_BOOT_OPTS {
+		return 0x80 // Parameter not supported
+	}
+	if len(data) > 0 && param == BOOT_OPT_INITIATOR_MAILBOX {
+		if data[0] >= BOOT_MAILBOX_BLOCKS {
+			return IPMI_PARAMETER_OUT_OF_RANGE_CC
+		}
+		if len(data) > bootOptLengths[param] {
+			return IPMI_REQUEST_DATA_LENGTH_INVALID_CC
+		}
+	} else if len(data) > 0 && len(data) != bootOptLengths[param] {
+		return IPMI_REQUEST_DATA_LENGTH_INVALID_CC
+	}
+
+	bootOpts.Locked[param] = locked
+	if locked || len(data) == 0 {
+		bootOptsSave()
+		return 0
+	}
+
+	switch param {
+	case BOOT_OPT_SET_IN_PROGRESS:
+		switch data[0] & 0x3 {
+		case 0:
+			bootOpts.SetInProgress = 0
+		case 1:
+			if bootOpts.SetInProgress == 1 {
+				return 0x81 // Set already in progress
+			}
+			bootOpts.SetInProgress = 1
+		case 2:
+			// Commit write - all writes take effect at once
+		default:
+			return IPMI_INVALID_DATA_FIELD_CC
+		}
+	case BOOT_OPT_SERVICE_PARTITION:
+		bootOpts.ServicePartition = data[0]
+	case BOOT_OPT_SERVICE_SCAN:
+		bootOpts.ServiceScan = data[0] & 0x3
+	case BOOT_OPT_VALID_BIT_CLEARING:
+		bootOpts.ValidBitClearing = data[0] & 0x1f
+	case BOOT_OPT_BOOT_INFO_ACK:
+		bootOpts.BootInfoAck = (bootOpts.BootInfoAck &^ data[0]) |
+			(data[1] & data[0])
+	case BOOT_OPT_BOOT_FLAGS:
+		copy(bootOpts.BootFlags[:], data)
+		bootOpts.BootFlagsUsed = false
+		if data[0]&BOOT_FLAGS_VALID != 0 {
+			bootFlagsTimerStart()
+		} else {
+			bootFlagsTimerStop()
+		}
+	case BOOT_OPT_INITIATOR_INFO:
+		copy(bootOpts.InitiatorInfo[:], data)
+	case BOOT_OPT_INITIATOR_MAILBOX:
+		copy(bootOpts.Mailbox[data[0]][:], data[1:])
+	}
+	bootOptsSave()
+	return 0
+}
+
+// Return the wire data for a boot option parameter
+func bootOptGet(param uint8, setSel uint8) ([]uint8, uint8) {
+	var data []uint8
+
+	switch param {
+	case BOOT_OPT_SET_IN_PROGRESS:
+		data = []uint8{bootOpts.SetInProgress}
+	case BOOT_OPT_SERVICE_PARTITION:
+		data = []uint8{bootOpts.ServicePartition}
+	case BOOT_OPT_SERVICE_SCAN:
+		data = []uint8{bootOpts.ServiceScan}
+	case BOOT_OPT_VALID_BIT_CLEARING:
+		data = []uint8{bootOpts.ValidBitClearing}
+	case BOOT_OPT_BOOT_INFO_ACK:
+		data = []uint8{0, bootOpts.BootInfoAck}
+	case BOOT_OPT_BOOT_FLAGS:
+		data = bootOpts.BootFlags[:]
+	case BOOT_OPT_INITIATOR_INFO:
+		data = bootOpts.InitiatorInfo[:]
+	case BOOT_OPT_INITIATOR_MAILBOX:
+		if setSel >= BOOT_MAILBOX_BLOCKS {
+			return nil, IPMI_PARAMETER_OUT_OF_RANGE_CC
+		}
+		data = append([]uint8{setSel}, bootOpts.Mailbox[setSel][:]...)
+	default:
+		return nil, 0x80 // Parameter not supported
+	}
+	return data, 0
+}
@@ -0,0 +1,111 @@
+// Copyright 2015 Platina Systems, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style license described in the
+// LICENSE file.
+
+// Package contains IPMI 2.0 spec implementation
+package ipmigod
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// Valid boot flags time out from the main loop unless the valid bit
+// clearing parameter says not to
+func TestBootFlagsTimer(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		clearing uint8
+		timed    bool
+	}{
+		{"timed out", 0, true},
+		{"no timeout", 0x10, false},
+	} {
+		mcTestReset(t)
+		bootOpts.ValidBitClearing = c.clearing
+		bootOpts.BootFlags[0] = BOOT_FLAGS_VALID
+		bootFlagsTimerStart()
+		if (bootFlagsTimer != nil) != c.timed {
+			t.Errorf("%s: timer %v", c.name, bootFlagsTimer)
+			continue
+		}
+		if !c.timed {
+			continue
+		}
+
+		bootFlagsTimer.Reset(time.Millisecond)
+		<-timerChan(bootFlagsTimer)
+		bootFlagsExpired()
+		bootOptsLoad()
+		if bootOpts.BootFlags[0]&BOOT_FLAGS_VALID != 0 ||
+			bootFlagsTimer != nil {
+			t.Errorf("%s: boot flags %#x", c.name,
+				bootOpts.BootFlags[0])
+		}
+	}
+}
+
+// Each parameter set is read back the same, also after a restart
+func TestSystemBootOptions(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		set   []uint8
+		setCc uint8
+		get   []uint8
+		getCc uint8
+		data  []uint8
+	}{
+		{"no parameter", nil, IPMI_REQUEST_DATA_LENGTH_INVALID_CC,
+			nil, 0, nil},
+		{"short flags", []uint8{BOOT_OPT_BOOT_FLAGS, 0x80, 0x04, 0},
+			IPMI_REQUEST_DATA_LENGTH_INVALID_CC, nil, 0, nil},
+		{"unknown parameter", []uint8{NUM_BOOT_OPTS, 0}, 0x80,
+			[]uint8{NUM_BOOT_OPTS, 0, 0}, 0x80, nil},
+		{"bad set in progress", []uint8{BOOT_OPT_SET_IN_PROGRESS, 3},
+			IPMI_INVALID_DATA_FIELD_CC, nil, 0, nil},
+		{"bad mailbox block", []uint8{BOOT_OPT_INITIATOR_MAILBOX,
+			BOOT_MAILBOX_BLOCKS, 1}, IPMI_PARAMETER_OUT_OF_RANGE_CC,
+			[]uint8{BOOT_OPT_INITIATOR_MAILBOX, BOOT_MAILBOX_BLOCKS,
+				0}, IPMI_PARAMETER_OUT_OF_RANGE_CC, nil},
+		{"short get", nil, IPMI_REQUEST_DATA_LENGTH_INVALID_CC,
+			[]uint8{BOOT_OPT_BOOT_FLAGS, 0},
+			IPMI_REQUEST_DATA_LENGTH_INVALID_CC, nil},
+		{"pxe once", []uint8{BOOT_OPT_BOOT_FLAGS, 0x80, 0x04, 0, 0, 0},
+			0, []uint8{BOOT_OPT_BOOT_FLAGS, 0, 0}, 0,
+			[]uint8{0x80, 0x04, 0, 0, 0}},
+		{"service partition", []uint8{BOOT_OPT_SERVICE_PARTITION, 7},
+			0, []uint8{BOOT_OPT_SERVICE_PARTITION, 0, 0}, 0,
+			[]uint8{7}},
+		{"boot info ack", []uint8{BOOT_OPT_BOOT_INFO_ACK, 0x03, 0x01},
+			0, []uint8{BOOT_OPT_BOOT_INFO_ACK, 0, 0}, 0,
+			[]uint8{0, 0x01}},
+		{"mailbox", []uint8{BOOT_OPT_INITIATOR_MAILBOX, 2, 'o', 'n',
+			'i', 'e'}, 0, []uint8{BOOT_OPT_INITIATOR_MAILBOX, 2, 0},
+			0, append([]uint8{2, 'o', 'n', 'i', 'e'},
+				make([]uint8, BOOT_MAILBOX_BLOCK_LEN-4)...)},
+	} {
+		mcTestReset(t)
+		rsp := testMsgRun(t, testMsgBuild(CHASSIS_NETFN,
+			SET_SYSTEM_BOOT_OPTIONS_CMD, c.set), setSystemBootOptions)
+		if rsp[0] != c.setCc {
+			t.Errorf("%s: set completion code %#x", c.name, rsp[0])
+		}
+		if c.get == nil {
+			continue
+		}
+
+		bootOpts = bootOptsT{}
+		bootOptsLoad()
+		rsp = testMsgRun(t, testMsgBuild(CHASSIS_NETFN,
+			GET_SYSTEM_BOOT_OPTIONS_CMD, c.get), getSystemBootOptions)
+		if rsp[0] != c.getCc {
+			t.Errorf("%s: get completion code %#x", c.name, rsp[0])
+			continue
+		}
+		if c.getCc == 0 && (rsp[1] != BOOT_OPT_PARAM_VERSION ||
+			rsp[2] != c.get[0] || !bytes.Equal(rsp[3:], c.data)) {
+			t.Errorf("%s: get response % x", c.name, rsp)
+		}
+	}
+}
@@ -0,0 +1,354 @@
+// Copyright 2015 Platina Systems, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style license described in the
+// LICENSE file.
+
+// Package contains IPMI 2.0 spec implementation
+package ipmigod
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Chassis control actions
+const (
+	CHASSIS_POWER_DOWN     = 0
+	CHASSIS_POWER_UP       = 1
+	CHASSIS_POWER_CYCLE    = 2
+	CHASSIS_HARD_RESET     = 3
+	CHASSIS_DIAG_INTERRUPT = 4
+	CHASSIS_SOFT_SHUTDOWN  = 5
+)
+
+// Power restore policies, encoded as in Get Chassis Status
+const (
+	POWER_RESTORE_ALWAYS_OFF = 0
+	POWER_RESTORE_PREVIOUS   = 1
+	POWER_RESTORE_ALWAYS_ON  = 2
+	POWER_RESTORE_UNKNOWN    = 3
+)
+
+// System restart causes, as in Get System Restart Cause
+const (
+	RESTART_CAUSE_UNKNOWN          = 0x0
+	RESTART_CAUSE_CHASSIS_CONTROL  = 0x1
+	RESTART_CAUSE_RESET_BUTTON     = 0x2
+	RESTART_CAUSE_POWER_BUTTON     = 0x3
+	RESTART_CAUSE_WATCHDOG         = 0x4
+	RESTART_CAUSE_OEM              = 0x5
+	RESTART_CAUSE_RESTORE_ALWAYS   = 0x6
+	RESTART_CAUSE_RESTORE_PREVIOUS = 0x7
+	RESTART_CAUSE_PEF_RESET        = 0x8
+	RESTART_CAUSE_PEF_POWER_CYCLE  = 0x9
+	RESTART_CAUSE_SOFT_RESET       = 0xa
+	RESTART_CAUSE_RTC_WAKEUP       = 0xb
+)
+
+// Chassis identify states, encoded as in Get Chassis Status
+const (
+	IDENTIFY_OFF        = 0
+	IDENTIFY_TIMED_ON   = 1
+	IDENTIFY_FORCED_ON  = 2
+	IDENTIFY_DEFAULT_ON = 15 * time.Second
+)
+
+// Script run by the exec chassis driver on real hw. It is invoked
+// with one of "status", "on", "off", "cycle", "reset", "diag" or
+// "soft" and must print "on" or "off" for "status".
+var chassisScript string = "/usr/sbin/ipmigod-chassis"
+
+const CHASSIS_SCRIPT_TIMEOUT = 10 * time.Second
+
+const (
+	CHASSIS_STATE_FILE = "chassis.json"
+
+	// Power-on hours counter
+	POH_MINUTES_PER_COUNT = 60
+	POH_SAVE_MINUTES      = 10
+	POH_TICK              = time.Minute
+)
+
+type chassisT struct {
+	driver            chassisDriver
+	restorePolicy     uint8
+	powerOn           bool // last known power state
+	restartCause      uint8
+	restartChannel    uint8
+	pohMinutes        uint32
+	lastPowerEvent    uint8
+	powerFault        bool
+	powerControlFault bool
+	coolingFault      bool
+	driveFault        bool
+
+	identify      identifyDriver
+	identifyState uint8
+	identifyTimer *time.Timer
+
+	// Discrete sensor states, see chassisSensorSet
+	watchdogState  uint16
+	buttonState    uint16
+	watchdogSensor *sensorT
+	buttonSensor   *sensorT
+}
+
+// Chassis state kept across ipmigod restarts
+type chassisSavedT struct {
+	RestorePolicy  uint8
+	PowerOn        bool
+	RestartCause   uint8
+	RestartChannel uint8
+	PohMinutes     uint32
+}
+
+func chassisLoad() {
+	var saved chassisSavedT
+
+	saved.RestorePolicy = POWER_RESTORE_PREVIOUS
+	err := stateLoad(CHASSIS_STATE_FILE, &saved)
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Println("chassisLoad:", err)
+	}
+	mc.chassis.restorePolicy = saved.RestorePolicy
+	mc.chassis.powerOn = saved.PowerOn
+	mc.chassis.restartCause = saved.RestartCause
+	mc.chassis.restartChannel = saved.RestartChannel
+	mc.chassis.pohMinutes = saved.PohMinutes
+}
+
+func chassisSave() {
+	saved := chassisSavedT{
+		RestorePolicy:  mc.chassis.restorePolicy,
+		PowerOn:        mc.chassis.powerOn,
+		RestartCause:   mc.chassis.restartCause,
+		RestartChannel: mc.chassis.restartChannel,
+		PohMinutes:     mc.chassis.pohMinutes,
+	}
+	err := stateSave(CHASSIS_STATE_FILE, &saved)
+	if err != nil {
+		fmt.Println("chassisSave:", err)
+	}
+}
+
+// Record the power state if it changed since last saved
+func chassisPowerOnUpdate(on bool) {
+	if mc.chassis.powerOn != on {
+		mc.chassis.powerOn = on
+		chassisSave()
+		if on {
+			bootOptsPowerOn()
+		}
+	}
+}
+
+// Called by whichever subsystem restarts the system. The watchdog
+// sensor shows whether the watchdog caused the last restart.
+func chassisRestartCauseSet(cause uint8, channel uint8) {
+	var watchdog uint16
+
+	mc.chassis.restartCause = cause
+	mc.chassis.restartChannel = channel
+	chassisSave()
+	bootOptsRestart(cause)
+
+	if cause == RESTART_CAUSE_WATCHDOG {
+		watchdog = 1 << WATCHDOG_HARD_RESET
+	}
+	chassisSensorSet(mc.chassis.watchdogSensor, &mc.chassis.watchdogState,
+		watchdog)
+}
+
+// Power and reset controls show as presses of the matching button,
+// asserted then released.
+func chassisButtonPress(button uint) {
+	chassisSensorSet(mc.chassis.buttonSensor, &mc.chassis.buttonState,
+		1<<button)
+	chassisSensorSet(mc.chassis.buttonSensor, &mc.chassis.buttonState, 0)
+}
+
+// Apply the power restore policy at startup
+func chassisPowerRestore() {
+	var cause uint8
+
+	on, err := mc.chassis.driver.powerState()
+	if err != nil {
+		fmt.Println("chassisPowerRestore:", err)
+		return
+	}
+
+	switch mc.chassis.restorePolicy {
+	case POWER_RESTORE_ALWAYS_ON:
+		cause = RESTART_CAUSE_RESTORE_ALWAYS
+	case POWER_RESTORE_PREVIOUS:
+		if !mc.chassis.powerOn {
+			chassisPowerOnUpdate(on)
+			return
+		}
+		cause = RESTART_CAUSE_RESTORE_PREVIOUS
+	default:
+		chassisPowerOnUpdate(on)
+		return
+	}
+
+	if !on {
+		err = mc.chassis.driver.control(CHASSIS_POWER_UP)
+		if err != nil {
+			fmt.Println("chassisPowerRestore:", err)
+			mc.chassis.powerControlFault = true
+			chassisPowerOnUpdate(false)
+			return
+		}
+		chassisRestartCauseSet(cause, 0)
+	}
+	chassisPowerOnUpdate(true)
+}
+
+// Accumulate power-on minutes while the chassis is on, called from the
+// main loop every POH_TICK. The count is saved every POH_SAVE_MINUTES
+// so at most that much is lost across a BMC restart.
+func chassisPohTick() {
+	on, err := mc.chassis.driver.powerState()
+	if err != nil {
+		fmt.Println("chassisPoh:", err)
+		return
+	}
+	if !on {
+		chassisPowerOnUpdate(false)
+		return
+	}
+	mc.chassis.pohMinutes++
+	if !mc.chassis.powerOn {
+		chassisPowerOnUpdate(true)
+	} else if mc.chassis.pohMinutes%POH_SAVE_MINUTES == 0 {
+		chassisSave()
+	}
+}
+
+// Sysfs leds matched to find the identify led on real hw
+var identifyLedGlob string = "/sys/class/leds/*identify*"
+
+// Platform hooks used to carry out chassis commands
+type chassisDriver interface {
+	powerState() (on bool, err error)
+	control(action uint8) error
+}
+
+// Used for artificial qemu environment - just tracks state.
+type simChassisDriver struct {
+	on bool
+}
+
+func (d *simChassisDriver) powerState() (bool, error) {
+	return d.on, nil
+}
+
+func (d *simChassisDriver) control(action uint8) error {
+	switch action {
+	case CHASSIS_POWER_DOWN, CHASSIS_SOFT_SHUTDOWN:
+		d.on = false
+	case CHASSIS_POWER_UP, CHASSIS_POWER_CYCLE, CHASSIS_HARD_RESET:
+		d.on = true
+	}
+	if debug {
+		fmt.Println("simChassisDriver: action", action, "on", d.on)
+	}
+	return nil
+}
+
+// Runs an external script to operate the switch's power controls
+type execChassisDriver struct {
+	path string
+}
+
+var execChassisActions = map[uint8]string{
+	CHASSIS_POWER_DOWN:     "off",
+	CHASSIS_POWER_UP:       "on",
+	CHASSIS_POWER_CYCLE:    "cycle",
+	CHASSIS_HARD_RESET:     "reset",
+	CHASSIS_DIAG_INTERRUPT: "diag",
+	CHASSIS_SOFT_SHUTDOWN:  "soft",
+}
+
+func (d *execChassisDriver) run(arg string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(),
+		CHASSIS_SCRIPT_TIMEOUT)
+	defer cancel()
+
+	out, err := exec.CommandContext(ctx, d.path, arg).Output()
+	if err != nil {
+		return "", fmt.Errorf("%s %s: %v", d.path, arg, err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+func (d *execChassisDriver) powerState() (bool, error) {
+	out, err := d.run("status")
+	if err != nil {
+		return false, err
+	}
+	switch out {
+	case "on":
+		return true, nil
+	case "off":
+		return false, nil
+	}
+	return false, fmt.Errorf("%s status: unexpected output %q",
+		d.path, out)
+}
+
+func (d *execChassisDriver) control(action uint8) error {
+	arg, ok := execChassisActions[action]
+	if !ok {
+		return fmt.Errorf("unsupported chassis action %d", action)
+	}
+	_, err := d.run(arg)
+	return err
+}
+
+// Platform hook that lights the chassis identify indicator
+type identifyDriver interface {
+	setIdentify(on bool) error
+}
+
+// Used for artificial qemu environment - just logs the led state.
+type simIdentifyDriver struct{}
+
+func (d *simIdentifyDriver) setIdentify(on bool) error {
+	fmt.Println("Chassis identify", on)
+	return nil
+}
+
+// Drives a sysfs led (/sys/class/leds/<led>)
+type sysfsLedDriver struct {
+	dir string
+}
+
+func (d *sysfsLedDriver) setIdentify(on bool) error {
+	brightness := []byte("0")
+	if on {
+		// Use the led's max brightness if it tells us one
+		max, err := os.ReadFile(filepath.Join(d.dir, "max_brightness"))
+		if err == nil {
+			brightness = []byte(strings.TrimSpace(string(max)))
+		} else {
+			brightness = []byte("1")
+		}
+	}
+	return os.WriteFile(filepath.Join(d.dir, "brightness"), brightness,
+		0644)
+}
+
+// Find the first sysfs led matching identifyLedGlob
+func newSysfsLedDriver() identifyDriver {
+	dirs, _ := filepath.Glob(identifyLedGlob)
+	if len(dirs) == 0 {
+		fmt.Println("No identify led matching", identifyLedGlob)
+		return &simIdentifyDriver{}
+	}
+	return &sysfsLedDriver{dir: dirs[0]}
+}
@@ -0,0 +1,361 @@
+// Copyright 2015 Platina Systems, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style license described in the
+// LICENSE file.
+
+// Package contains IPMI 2.0 spec implementation
+package ipmigod
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// Event/reading type codes of discrete sensors
+const (
+	REDUNDANCY_READING_TYPE      = 0x0b
+	SENSOR_SPECIFIC_READING_TYPE = 0x6f
+)
+
+// Sensor types
+const (
+	SENSOR_TYPE_FAN             = 0x04
+	SENSOR_TYPE_POWER_SUPPLY    = 0x08
+	SENSOR_TYPE_BUTTON          = 0x14
+	SENSOR_TYPE_WATCHDOG_2      = 0x23
+	SENSOR_TYPE_ENTITY_PRESENCE = 0x25
+)
+
+// Power supply sensor-specific offsets
+const (
+	PSU_PRESENCE_DETECTED  = 0
+	PSU_FAILURE_DETECTED   = 1
+	PSU_PREDICTIVE_FAILURE = 2
+	PSU_INPUT_LOST         = 3
+)
+
+// Generic redundancy offsets
+const (
+	REDUNDANCY_FULL                       = 0
+	REDUNDANCY_LOST                       = 1
+	REDUNDANCY_DEGRADED                   = 2
+	REDUNDANCY_NON_REDUNDANT_SUFFICIENT   = 3
+	REDUNDANCY_NON_REDUNDANT_INSUFFICIENT = 5
+)
+
+// Watchdog 2 sensor-specific offsets
+const (
+	WATCHDOG_TIMER_EXPIRED   = 0
+	WATCHDOG_HARD_RESET      = 1
+	WATCHDOG_POWER_DOWN      = 2
+	WATCHDOG_POWER_CYCLE     = 3
+	WATCHDOG_TIMER_INTERRUPT = 8
+)
+
+// Entity presence sensor-specific offsets
+const (
+	ENTITY_PRESENT  = 0
+	ENTITY_ABSENT   = 1
+	ENTITY_DISABLED = 2
+)
+
+// Button/switch sensor-specific offsets
+const (
+	BUTTON_POWER = 0
+	BUTTON_SLEEP = 1
+	BUTTON_RESET = 2
+)
+
+// Entity ids
+const (
+	ENTITY_SYSTEM_BOARD   = 0x07
+	ENTITY_POWER_SUPPLY   = 0x0a
+	ENTITY_ADD_IN_CARD    = 0x0b
+	ENTITY_SYSTEM_CHASSIS = 0x17
+	ENTITY_COOLING_UNIT   = 0x1e
+)
+
+// An LC that has not been heard from in this long is absent
+const CARD_PRESENCE_TIMEOUT = 10 * time.Second
+
+var powerSupplyRoot = "/sys/class/power_supply"
+
+// Discrete sensors read their state bitmap, one bit per offset, from a
+// sensorSource like the analog ones do their value. This lets the
+// simulation sources script them as well.
+func discreteState(reading float64) uint16 {
+	return uint16(reading) & 0x7fff
+}
+
+// Generate an event for each offset whose state differs from what was
+// last reported.
+func sensorDiscreteEvaluate(sensor *sensorT) {
+	if sensor.eventReadingCode == THRESHOLD_EVENT_TYPE {
+		return
+	}
+
+	changed := sensor.eventStatus ^ sensor.eventState
+	for offset := uint(0); offset < 15; offset++ {
+		if changed&(1<<offset) == 0 {
+			continue
+		}
+		// No event data 2/3
+		evData := [3]uint8{uint8(offset), 0xff, 0xff}
+		sensorEventGenerate(sensor,
+			sensor.eventStatus&(1<<offset) == 0, offset, evData)
+	}
+	sensor.eventState = sensor.eventStatus
+}
+
+// First free sensor number from the top of this card's block, keeping
+// clear of the analog sensors allocated from the bottom.
+func discreteSensorNum() (lun uint8, num uint8, ok bool) {
+	for i := len(hwmonSensorLuns)*15 - 1; i >= 0; i-- {
+		lun, num, ok = hwmonSensorNum(i)
+		if ok && mc.sensors[lun][num] == nil {
+			return lun, num, true
+		}
+	}
+	return 0, 0, false
+}
+
+// Create a discrete sensor with a full sensor sdr. The offsets mask
+// gives the states the sensor can report, each generating assertion
+// and deassertion events.
+func discreteSensorAdd(name string, sensorType uint8, code uint8,
+	entityId uint8, entityInstance uint8, offsets uint16,
+	source sensorSource) *sensorT {
+
+	lun, sensNum, ok := discreteSensorNum()
+	if !ok {
+		fmt.Println("discreteSensorAdd: out of sensor numbers for",
+			name)
+		return nil
+	}
+
+	sensorAdd(mc.bmcIpmb, lun, sensNum, sensorType, code)
+	sensor := mc.sensors[lun][sensNum]
+	sensor.source = source
+	mainSdrAdd(&FullSensorSdr{
+		SdrSensor: SdrSensor{OwnerId: mc.bmcIpmb, OwnerLun: lun,
+			Number: sensNum, EntityId: entityId,
+			EntityInstance: entityInstance},
+		Init:             0x63,
+		Caps:             0x40,
+		SensorType:       sensorType,
+		EventReadingType: code,
+		AssertionMask:    offsets,
+		DeassertionMask:  offsets,
+		ReadingMask:      offsets,
+		Units1:           0xc0,
+		Linearization:    SDR_LINEAR,
+		SdrId:            sdrId(name),
+	})
+	return sensor
+}
+
+// Create the discrete sensors of this card
+func discreteSensorsAdd() {
+	card := strconv.Itoa(int(chassisCardNum))
+
+	if !simulate {
+		psus, err := powerSupplyScan(powerSupplyRoot)
+		if err != nil {
+			fmt.Println("discreteSensorsAdd:", err)
+		}
+		// Sdrs are told apart by card in the entity instance, the
+		// supply's number is in the id string
+		for i, dir := range psus {
+			discreteSensorAdd(card+"PSU"+strconv.Itoa(i+1),
+				SENSOR_TYPE_POWER_SUPPLY,
+				SENSOR_SPECIFIC_READING_TYPE,
+				ENTITY_POWER_SUPPLY, chassisCardNum,
+				1<<PSU_PRESENCE_DETECTED|
+					1<<PSU_FAILURE_DETECTED|
+					1<<PSU_INPUT_LOST,
+				&powerSupplySourceT{dir: dir})
+		}
+	} else {
+		discreteSensorAdd(card+"PSU1", SENSOR_TYPE_POWER_SUPPLY,
+			SENSOR_SPECIFIC_READING_TYPE, ENTITY_POWER_SUPPLY,
+			chassisCardNum,
+			1<<PSU_PRESENCE_DETECTED|1<<PSU_FAILURE_DETECTED|
+				1<<PSU_INPUT_LOST, nil)
+	}
+
+	// Fan redundancy only means something with more than one fan
+	fans := 0
+	for lun := range mc.sensors {
+		for _, sensor := range mc.sensors[lun] {
+			if sensor != nil &&
+				sensor.sensorType == SENSOR_TYPE_FAN &&
+				sensor.eventReadingCode == THRESHOLD_EVENT_TYPE {
+				fans++
+			}
+		}
+	}
+	if fans > 1 {
+		discreteSensorAdd(card+"FanRedundancy", SENSOR_TYPE_FAN,
+			REDUNDANCY_READING_TYPE, ENTITY_COOLING_UNIT,
+			chassisCardNum,
+			1<<REDUNDANCY_FULL|1<<REDUNDANCY_LOST|
+				1<<REDUNDANCY_NON_REDUNDANT_SUFFICIENT|
+				1<<REDUNDANCY_NON_REDUNDANT_INSUFFICIENT,
+			&fanRedundancySourceT{})
+	}
+
+	// Watchdog and buttons follow the chassis code, see
+	// chassisRestartCauseSet and chassisButtonPress
+	mc.chassis.watchdogSensor = discreteSensorAdd(card+"Watchdog",
+		SENSOR_TYPE_WATCHDOG_2, SENSOR_SPECIFIC_READING_TYPE,
+		ENTITY_SYSTEM_BOARD, chassisCardNum, 1<<WATCHDOG_HARD_RESET,
+		&chassisStateSourceT{state: &mc.chassis.watchdogState})
+	mc.chassis.buttonSensor = discreteSensorAdd(card+"Button",
+		SENSOR_TYPE_BUTTON, SENSOR_SPECIFIC_READING_TYPE,
+		ENTITY_SYSTEM_CHASSIS, chassisCardNum,
+		1<<BUTTON_POWER|1<<BUTTON_RESET,
+		&chassisStateSourceT{state: &mc.chassis.buttonState})
+}
+
+// Mains power supplies under the power_supply class
+func powerSupplyScan(root string) ([]string, error) {
+	var psus []string
+
+	dirs, err := filepath.Glob(filepath.Join(root, "*"))
+	if err != nil {
+		return nil, err
+	}
+	for _, dir := range dirs {
+		t, err := readSysfsString(filepath.Join(dir, "type"))
+		if err == nil && t == "Mains" {
+			psus = append(psus, dir)
+		}
+	}
+	return psus, nil
+}
+
+// Power supply state from its power_supply class attributes
+type powerSupplySourceT struct {
+	dir string
+}
+
+func (s *powerSupplySourceT) read() (float64, error) {
+	var state uint16
+
+	// Without a present attribute, having an online one will do
+	present, err := readSysfsInt(filepath.Join(s.dir, "present"))
+	if err != nil {
+		_, err = readSysfsInt(filepath.Join(s.dir, "online"))
+		if err != nil {
+			return 0, err
+		}
+		present = 1
+	}
+	if present == 0 {
+		return 0, nil
+	}
+	state |= 1 << PSU_PRESENCE_DETECTED
+
+	health, err := readSysfsString(filepath.Join(s.dir, "health"))
+	if err == nil && health != "Good" && health != "Unknown" {
+		state |= 1 << PSU_FAILURE_DETECTED
+	}
+	online, err := readSysfsInt(filepath.Join(s.dir, "online"))
+	if err == nil && online == 0 {
+		state |= 1 << PSU_INPUT_LOST
+	}
+	return float64(state), nil
+}
+
+// Fan redundancy derived from the fan sensors; a fan at or below its
+// lower critical threshold counts as failed. One failure leaves the
+// fans sufficient but no longer redundant.
+type fanRedundancySourceT struct{}
+
+func (s *fanRedundancySourceT) localSource() {}
+
+func (s *fanRedundancySourceT) read() (float64, error) {
+	var state uint16
+
+	failed := 0
+	for lun := range mc.sensors {
+		for _, sensor := range mc.sensors[lun] {
+			if sensor == nil ||
+				sensor.sensorType != SENSOR_TYPE_FAN ||
+				sensor.eventReadingCode != THRESHOLD_EVENT_TYPE {
+				continue
+			}
+			if sensor.eventStatus&(1<<THRESHOLD_LC|
+				1<<THRESHOLD_LNR) != 0 {
+				failed++
+			}
+		}
+	}
+	switch failed {
+	case 0:
+		state = 1 << REDUNDANCY_FULL
+	case 1:
+		state = 1<<REDUNDANCY_LOST |
+			1<<REDUNDANCY_NON_REDUNDANT_SUFFICIENT
+	default:
+		state = 1<<REDUNDANCY_LOST |
+			1<<REDUNDANCY_NON_REDUNDANT_INSUFFICIENT
+	}
+	return float64(state), nil
+}
+
+// Watchdog or button state kept by the chassis code
+type chassisStateSourceT struct {
+	state *uint16
+}
+
+func (s *chassisStateSourceT) localSource() {}
+
+func (s *chassisStateSourceT) read() (float64, error) {
+	return float64(*s.state), nil
+}
+
+// Set the state of a chassis sensor and report it right away rather
+// than at the next poll, which would miss a button press.
+func chassisSensorSet(sensor *sensorT, state *uint16, value uint16) {
+	*state = value
+	if sensor != nil && sensor.scanningEnabled && sensor.sdr != nil &&
+		!sensor.reading {
+		sensorPoll(sensor, sensor.sdr)
+	}
+}
+
+// The MM tracks LC presence by their sdr traffic, which includes the
+// sensor value updates every poll. The first time a card is heard from
+// it gets an entity presence sensor. Only records owned by the card's
+// own BMC count, so a stray instance number doesn't make a card appear.
+// Called on the main loop, which also polls the presence sensors.
+func cardSeen(key *SdrSensor) {
+	card := key.EntityInstance
+	if chassisCardNum > 0 || card == 0 ||
+		key.OwnerId != cardIpmbAddr(card) {
+		return
+	}
+	if _, ok := mc.cardLastSeen[card]; !ok {
+		discreteSensorAdd("Card"+strconv.Itoa(int(card))+"Presence",
+			SENSOR_TYPE_ENTITY_PRESENCE,
+			SENSOR_SPECIFIC_READING_TYPE, ENTITY_ADD_IN_CARD, card,
+			1<<ENTITY_PRESENT|1<<ENTITY_ABSENT,
+			&cardPresenceSourceT{card: card})
+	}
+	mc.cardLastSeen[card] = time.Now()
+}
+
+type cardPresenceSourceT struct {
+	card uint8
+}
+
+func (s *cardPresenceSourceT) localSource() {}
+
+func (s *cardPresenceSourceT) read() (float64, error) {
+	if time.Since(mc.cardLastSeen[s.card]) < CARD_PRESENCE_TIMEOUT {
+		return 1 << ENTITY_PRESENT, nil
+	}
+	return 1 << ENTITY_ABSENT, nil
+}
@@ -0,0 +1,225 @@
+// Copyright 2015 Platina Systems, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style license described in the
+// LICENSE file.
+
+// Package contains IPMI 2.0 spec implementation
+package ipmigod
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Each analog sensor keeps its last HistoryLength readings in memory.
+// With HistoryDir set every reading is also appended to a per-sensor
+// csv file of "unix-time,value" lines, rotated at HISTORY_FILE_MAX.
+//
+// They are set by the program running ipmigod before calling Ipmigod.
+var (
+	HistoryLength int    = 1200
+	HistoryDir    string = ""
+)
+
+const (
+	HISTORY_FILE_MAX = 1 << 20
+
+	// Keeps the response within a lan message
+	OEM_HISTORY_MAX_RSP = 200
+)
+
+// A converted sensor reading
+type HistorySample struct {
+	Time  time.Time
+	Value float64
+	Raw   uint8
+}
+
+// Ring buffer of a sensor's readings. The main loop adds to it while
+// callers of SensorHistory read it, hence the lock.
+type historyT struct {
+	sync.Mutex
+	samples []HistorySample
+	next    int
+	full    bool
+}
+
+func (h *historyT) add(s HistorySample) {
+	h.Lock()
+	defer h.Unlock()
+
+	if h.samples == nil {
+		h.samples = make([]HistorySample, HistoryLength)
+	}
+	h.samples[h.next] = s
+	h.next++
+	if h.next == len(h.samples) {
+		h.next = 0
+		h.full = true
+	}
+}
+
+// Samples no older than since, oldest first
+func (h *historyT) since(since time.Time) []HistorySample {
+	var out []HistorySample
+
+	h.Lock()
+	defer h.Unlock()
+
+	start, n := 0, h.next
+	if h.full {
+		start, n = h.next, len(h.samples)
+	}
+	for i := 0; i < n; i++ {
+		s := h.samples[(start+i)%len(h.samples)]
+		if !s.Time.Before(since) {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// Record a sensor's current reading
+func historyAdd(sensor *sensorT, entry *sdrT) {
+	if HistoryLength <= 0 || sensor.history == nil {
+		return
+	}
+	s := HistorySample{Time: time.Now(), Raw: sensor.value,
+		Value: sensorRealFromRaw(sensor, entry, sensor.value)}
+	sensor.history.add(s)
+
+	if HistoryDir != "" {
+		err := historySpill(sensor, s)
+		if err != nil {
+			fmt.Println("historyAdd:", err)
+		}
+	}
+}
+
+func historySpill(sensor *sensorT, s HistorySample) error {
+	err := os.MkdirAll(HistoryDir, 0755)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(HistoryDir,
+		fmt.Sprintf("sensor-%d-%d.csv", sensor.lun, sensor.num))
+	fi, err := os.Stat(path)
+	if err == nil && fi.Size() > HISTORY_FILE_MAX {
+		err = os.Rename(path, path+".1")
+		if err != nil {
+			return err
+		}
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE,
+		0644)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(f, "%d,%g\n", s.Time.Unix(), s.Value)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Readings of a sensor over the last window, oldest first. A zero
+// window returns all the readings kept.
+func SensorHistory(lun uint8, num uint8,
+	window time.Duration) []HistorySample {
+
+	if lun > 3 || num == 255 {
+		return nil
+	}
+	sensor := mc.sensors[lun][num]
+	if sensor == nil || sensor.history == nil {
+		return nil
+	}
+	var since time.Time
+	if window > 0 {
+		since = time.Now().Add(-window)
+	}
+	return sensor.history.since(since)
+}
+
+// Minimum, maximum and average of the samples' values
+func SensorHistoryStats(samples []HistorySample) (min, max,
+	avg float64) {
+
+	if len(samples) == 0 {
+		return 0, 0, 0
+	}
+	min, max = math.Inf(1), math.Inf(-1)
+	for _, s := range samples {
+		min = math.Min(min, s.Value)
+		max = math.Max(max, s.Value)
+		avg += s.Value
+	}
+	return min, max, avg / float64(len(samples))
+}
+
+// OEM get sensor history. After the IANA number the request has the
+// sensor number, the window in seconds (0 for all), and the index
+// (0 is the newest) and count of the samples wanted. The response has
+// the number of samples in the window, their min/max/average as raw
+// readings, then per sample a 4 byte timestamp and the raw reading,
+// newest first.
+func oemGetSensorHistory(msg *msgT) {
+	var data [OEM_HISTORY_MAX_RSP]uint8
+
+	if msg.reqDataLen() < 8 {
+		msg.returnErr(nil, IPMI_REQUEST_DATA_LENGTH_INVALID_CC)
+		return
+	}
+	dataStart := msg.dataStart + 3
+	lun := msg.rmcp.message.rsLun
+	sensNum := msg.data[dataStart]
+	window :=
+		binary.LittleEndian.Uint16(msg.data[dataStart+1 : dataStart+3])
+	index := int(msg.data[dataStart+3])
+	count := int(msg.data[dataStart+4])
+
+	entry := sdrFind(lun, sensNum)
+	if entry == nil {
+		msg.returnErr(nil, IPMI_NOT_PRESENT_CC)
+		return
+	}
+	if sensNum == 255 || mc.sensors[lun][sensNum] == nil {
+		// The history of an LC's sensor is kept on the LC
+		sensorForward(msg, entry)
+		return
+	}
+	sensor := mc.sensors[lun][sensNum]
+	if sensor.eventReadingCode != THRESHOLD_EVENT_TYPE {
+		msg.returnErr(nil, IPMI_COMMAND_ILLEGAL_FOR_SENSOR_CC)
+		return
+	}
+
+	samples := SensorHistory(lun, sensNum,
+		time.Duration(window)*time.Second)
+	min, max, avg := SensorHistoryStats(samples)
+
+	data[0] = 0
+	copy(data[1:4], mc.mfgId[:])
+	binary.LittleEndian.PutUint16(data[4:6], uint16(len(samples)))
+	data[6] = sensorRawFromReal(sensor, entry, min)
+	data[7] = sensorRawFromReal(sensor, entry, max)
+	data[8] = sensorRawFromReal(sensor, entry, avg)
+	n := 9
+	for i := len(samples) - 1 - index; i >= 0 && count > 0; i-- {
+		if n+5 > len(data) {
+			break
+		}
+		binary.LittleEndian.PutUint32(data[n:n+4],
+			uint32(samples[i].Time.Unix()))
+		data[n+4] = samples[i].Raw
+		n += 5
+		count--
+	}
+
+	msg.returnRspData(nil, data[0:n], uint(n))
+}
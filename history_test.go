@@ -0,0 +1,84 @@
+// Copyright 2015 Platina Systems, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style license described in the
+// LICENSE file.
+
+// Package contains IPMI 2.0 spec implementation
+package ipmigod
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestOemGetSensorHistory(t *testing.T) {
+	mcTestReset(t)
+	root := t.TempDir()
+	testTreeWrite(t, root, testHwmonTree)
+	hwmonSensorsAdd(root)
+
+	sensor := mc.sensors[0][2]
+	for _, raw := range []uint8{10, 20, 30} {
+		sensor.value = raw
+		historyAdd(sensor, sensor.sdr)
+	}
+
+	// IANA, sensor number, all of the window, newest two samples
+	req := []uint8{0, 0, 0, 2, 0, 0, 0, 2}
+	rsp := testMsgRun(t, testMsgBuild(OEM_GROUP_NETFN,
+		OEM_GET_SENSOR_HISTORY_CMD, req), oemGetSensorHistory)
+	if rsp[0] != 0 {
+		t.Fatalf("completion code %#x", rsp[0])
+	}
+	if n := binary.LittleEndian.Uint16(rsp[4:6]); n != 3 {
+		t.Errorf("%d samples in the window, want 3", n)
+	}
+	if len(rsp) != 9+2*5 || rsp[9+4] != 30 || rsp[9+5+4] != 20 {
+		t.Errorf("samples % x", rsp[9:])
+	}
+
+	rsp = testMsgRun(t, testMsgBuild(OEM_GROUP_NETFN,
+		OEM_GET_SENSOR_HISTORY_CMD, req[:7]), oemGetSensorHistory)
+	if rsp[0] != IPMI_REQUEST_DATA_LENGTH_INVALID_CC {
+		t.Errorf("short request completion code %#x", rsp[0])
+	}
+}
+
+// A full history file is rotated before the next reading is appended,
+// and a failed rotation is reported
+func TestHistorySpill(t *testing.T) {
+	defer func() { HistoryDir = "" }()
+	sensor := &sensorT{lun: 0, num: 2}
+
+	for _, c := range []struct {
+		name    string
+		blocked bool
+	}{
+		{"rotated", false},
+		{"rotate fails", true},
+	} {
+		HistoryDir = t.TempDir()
+		path := filepath.Join(HistoryDir, "sensor-0-2.csv")
+		testTreeWrite(t, HistoryDir, map[string]string{
+			"sensor-0-2.csv": "1,1"})
+		if err := os.Truncate(path, HISTORY_FILE_MAX+1); err != nil {
+			t.Fatal(err)
+		}
+		if c.blocked {
+			testTreeWrite(t, HistoryDir, map[string]string{
+				"sensor-0-2.csv.1/x": ""})
+		}
+
+		err := historySpill(sensor, HistorySample{
+			Time: time.Unix(100, 0), Value: 42.5})
+		if (err != nil) != c.blocked {
+			t.Errorf("%s: %v", c.name, err)
+		}
+		data, _ := os.ReadFile(path)
+		if !c.blocked && string(data) != "100,42.5\n" {
+			t.Errorf("%s: file %q", c.name, data)
+		}
+	}
+}
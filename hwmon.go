@@ -0,0 +1,337 @@
+// Copyright 2015 Platina Systems, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style license described in the
+// LICENSE file.
+
+// Package contains IPMI 2.0 spec implementation
+package ipmigod
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Root of the hwmon class tree. Can be pointed at a fake sysfs tree.
+var hwmonRoot string = "/sys/class/hwmon"
+
+// Scale from hwmon sysfs units to real units per input type
+var hwmonScales = map[string]float64{
+	"temp":  0.001,    // millidegree C
+	"in":    0.001,    // millivolt
+	"curr":  0.001,    // milliamp
+	"fan":   1,        // rpm
+	"power": 0.000001, // microwatt
+}
+
+var hwmonInputRe = regexp.MustCompile(`^(temp|in|curr|fan|power)(\d+)_input$`)
+
+// A hwmon sensor input, e.g. hwmon0/temp1_input
+type hwmonInputT struct {
+	chip  string // hwmonN/name
+	kind  string // temp, in, curr, fan or power
+	index int
+	label string // hwmonN/<kind><index>_label if any
+	dir   string
+	path  string
+}
+
+// Input name as used in the hwmon attribute names, e.g. "temp1"
+func (in *hwmonInputT) name() string {
+	return in.kind + strconv.Itoa(in.index)
+}
+
+// Path of another attribute of this input, e.g. "max"
+func (in *hwmonInputT) attr(attr string) string {
+	return filepath.Join(in.dir, in.name()+"_"+attr)
+}
+
+func readSysfsString(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+func readSysfsInt(path string) (int64, error) {
+	s, err := readSysfsString(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(s, 10, 64)
+}
+
+// Find the sensor inputs of every hwmon device under root
+func hwmonScan(root string) ([]hwmonInputT, error) {
+	var inputs []hwmonInputT
+
+	devs, err := filepath.Glob(filepath.Join(root, "hwmon*"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(devs)
+
+	for _, dev := range devs {
+		// Older drivers keep their attributes under device/
+		for _, dir := range []string{dev, filepath.Join(dev, "device")} {
+			chip, err := readSysfsString(filepath.Join(dir, "name"))
+			if err != nil {
+				continue
+			}
+			files, err := os.ReadDir(dir)
+			if err != nil {
+				continue
+			}
+			var devInputs []hwmonInputT
+			for _, f := range files {
+				m := hwmonInputRe.FindStringSubmatch(f.Name())
+				if m == nil {
+					continue
+				}
+				in := hwmonInputT{
+					chip: chip,
+					kind: m[1],
+					dir:  dir,
+					path: filepath.Join(dir, f.Name()),
+				}
+				in.index, _ = strconv.Atoi(m[2])
+				in.label, _ = readSysfsString(in.attr("label"))
+				devInputs = append(devInputs, in)
+			}
+			sort.Slice(devInputs, func(i, j int) bool {
+				a, b := devInputs[i], devInputs[j]
+				if a.kind != b.kind {
+					return a.kind < b.kind
+				}
+				return a.index < b.index
+			})
+			inputs = append(inputs, devInputs...)
+			break
+		}
+	}
+	return inputs, nil
+}
+
+// Reads a hwmon input and scales it to real units
+type hwmonSourceT struct {
+	path  string
+	scale float64
+	slow  bool
+}
+
+// Chips behind PMBus whose reads are slow I2C transactions, polled
+// every HWMON_SLOW_POLL. Others can be added before calling Ipmigod.
+var HwmonSlowChips = map[string]bool{
+	"pmbus":   true,
+	"ucd9000": true,
+	"ucd9200": true,
+	"ltc2978": true,
+	"ltc4215": true,
+}
+
+const HWMON_SLOW_POLL = 15 * time.Second
+
+func newHwmonSource(in *hwmonInputT) *hwmonSourceT {
+	return &hwmonSourceT{path: in.path, scale: hwmonScales[in.kind],
+		slow: HwmonSlowChips[in.chip]}
+}
+
+func (s *hwmonSourceT) pollPeriod() time.Duration {
+	if s.slow {
+		return HWMON_SLOW_POLL
+	}
+	return SENSOR_POLL_DEFAULT
+}
+
+func (s *hwmonSourceT) read() (float64, error) {
+	v, err := readSysfsInt(s.path)
+	if err != nil {
+		return 0, err
+	}
+	return float64(v) * s.scale, nil
+}
+
+// IPMI sensor type, sdr units and entity per hwmon input type
+var hwmonSensorTypes = map[string]struct {
+	sensorType uint8
+	units      uint8
+	entityId   uint8
+	maxDefault float64
+}{
+	"temp":  {0x01, 1, 0x07, 150},    // degrees C, system board
+	"in":    {0x02, 4, 0x07, 15},     // volts, system board
+	"curr":  {0x03, 5, 0x07, 50},     // amps, system board
+	"fan":   {0x04, 18, 0x1d, 25500}, // rpm, fan device
+	"power": {0x0b, 6, 0x07, 1000},   // watts, system board
+}
+
+// Threshold attributes in sdr byte order (UNR, UC, UNC, LNR, LC, LNC)
+var hwmonThresholdAttrs = [6]string{"emergency", "crit", "max", "",
+	"lcrit", "min"}
+
+// Readable/settable threshold mask bit per sdr threshold byte
+var sdrThresholdMaskBits = [6]uint{5, 4, 3, 2, 1, 0}
+
+// Luns sensors are numbered in, lun 2 is reserved
+var hwmonSensorLuns = [...]uint8{0, 1, 3}
+
+// Sensor lun and number of the i'th discovered input. Each card owns
+// a block of 15 sensor numbers which is repeated across luns.
+func hwmonSensorNum(i int) (lun uint8, num uint8, ok bool) {
+	n := 1 + (i % 15) + (16 * int(chassisCardNum))
+	if i >= len(hwmonSensorLuns)*15 || n >= 255 {
+		return 0, 0, false
+	}
+	return hwmonSensorLuns[i/15], uint8(n), true
+}
+
+// Sdr id string for an input, at most 16 characters
+func hwmonIdString(in *hwmonInputT) string {
+	name := in.label
+	if name == "" {
+		name = in.chip + "-" + in.name()
+	}
+	id := fmt.Sprintf("%d%s", chassisCardNum, name)
+	if len(id) > 16 {
+		id = id[:16]
+	}
+	return id
+}
+
+// Create a sensor and a full sensor sdr for each input found under root
+func hwmonSensorsAdd(root string) {
+	inputs, err := hwmonScan(root)
+	if err != nil {
+		fmt.Println("hwmonSensorsAdd:", err)
+		return
+	}
+
+	n := 0
+	for i := range inputs {
+		in := &inputs[i]
+		st, ok := hwmonSensorTypes[in.kind]
+		if !ok {
+			continue
+		}
+		lun, sensNum, ok := hwmonSensorNum(n)
+		if !ok {
+			fmt.Println("hwmonSensorsAdd: out of sensor numbers")
+			break
+		}
+		n++
+
+		source := newHwmonSource(in)
+		sensorAdd(mc.bmcIpmb, lun, sensNum, st.sensorType, 1)
+		mc.sensors[lun][sensNum].source = source
+		hwmonSdrAdd(in, source, st.sensorType, st.units, st.entityId,
+			st.maxDefault, lun, sensNum)
+	}
+}
+
+func hwmonSdrAdd(in *hwmonInputT, source *hwmonSourceT, sensorType uint8,
+	units uint8, entityId uint8, maxDefault float64, lun uint8,
+	sensNum uint8) {
+
+	var (
+		thresholds [6]float64
+		present    [6]bool
+		hyst       uint8
+		assMask    uint16
+		deassMask  uint16
+		rdMask     uint16
+	)
+
+	// Thresholds set the range, falling back on the current reading
+	for t, attr := range hwmonThresholdAttrs {
+		if attr == "" {
+			continue
+		}
+		v, err := readSysfsInt(in.attr(attr))
+		if err != nil {
+			continue
+		}
+		thresholds[t] = float64(v) * source.scale
+		present[t] = true
+	}
+	hi := 0.0
+	for t := 0; t < 3; t++ {
+		if present[t] && thresholds[t] > hi {
+			hi = thresholds[t]
+		}
+	}
+	if hi > 0 {
+		hi *= 1.25
+	} else if reading, err := source.read(); err == nil && reading > 0 {
+		hi = 2 * reading
+	} else {
+		hi = maxDefault
+	}
+	lo := 0.0
+	for t := 3; t < 6; t++ {
+		if !present[t] {
+			continue
+		}
+		if thresholds[t] < lo {
+			lo = thresholds[t]
+		}
+		if thresholds[t]*1.25 > hi {
+			hi = thresholds[t] * 1.25
+		}
+	}
+	sdr := &FullSensorSdr{
+		SdrSensor: SdrSensor{OwnerId: mc.bmcIpmb, OwnerLun: lun,
+			Number: sensNum, EntityId: entityId,
+			EntityInstance: chassisCardNum},
+		Init:             0x7f,
+		Caps:             0x68,
+		SensorType:       sensorType,
+		EventReadingType: 1,
+		Units2:           units,
+		SensorMax:        0xff,
+		SdrId:            sdrId(hwmonIdString(in)),
+	}
+	sdr.SetRange(lo, hi)
+
+	// Sdr threshold bytes run UNR..LNC
+	for t := range thresholds {
+		if !present[t] {
+			continue
+		}
+		sdr.Thresholds[THRESHOLD_UNR-t] = sdr.RawFromReal(thresholds[t])
+		bit := sdrThresholdMaskBits[t]
+		rdMask |= (1 << bit) | (1 << (bit + 8))
+		if t < 3 {
+			// Upper thresholds assert going high
+			assMask |= 1 << (2*bit + 1)
+			deassMask |= 1<<(2*bit+1) | 1<<(12+bit-3)
+		} else {
+			// Lower thresholds assert going low
+			assMask |= 1<<(2*bit) | 1<<(12+bit)
+			deassMask |= 1 << (2 * bit)
+		}
+	}
+	sdr.AssertionMask = assMask
+	sdr.DeassertionMask = deassMask
+	sdr.ReadingMask = rdMask
+
+	// hwmon max_hyst is where an over-max alarm clears
+	if present[2] {
+		v, err := readSysfsInt(in.attr("max_hyst"))
+		if err == nil {
+			clear := float64(v) * source.scale
+			if clear < thresholds[2] {
+				hyst = sdr.Thresholds[THRESHOLD_UNC] -
+					sdr.RawFromReal(clear)
+			}
+		}
+	}
+	sdr.PosHysteresis = hyst
+	sdr.NegHysteresis = hyst
+
+	mainSdrAdd(sdr)
+}
@@ -0,0 +1,185 @@
+// Copyright 2015 Platina Systems, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style license described in the
+// LICENSE file.
+
+// Package contains IPMI 2.0 spec implementation
+package ipmigod
+
+import (
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Start a test with an empty sdr repository and no sensors
+func mcTestReset(t *testing.T) {
+	stateDir = t.TempDir()
+	chassisCardNum = 0
+	mc.bmcIpmb = cardIpmbAddr(0)
+	mc.mainSdrs = sdrsT{maxSdrCount: MAX_NUM_SDRS, nextFreeEntryId: 1}
+	mc.sensors = [4][255]*sensorT{}
+	mc.sensorList = nil
+	mc.sel = selT{maxCount: 1000, nextEntry: 1}
+	mc.chassis = chassisT{driver: &simChassisDriver{on: true},
+		identify: &simIdentifyDriver{}}
+	bootFlagsTimerStop()
+	bootOpts = bootOptsT{}
+	for _, conn := range mc.ipmbConns {
+		conn.Close()
+	}
+	mc.bridgePending = make(map[uint8]*bridgeReqT)
+	mc.ipmbRoutes = make(map[uint8]string)
+	mc.ipmbConns = make(map[uint8]net.Conn)
+	mc.rcvEnabled = [IPMI_MAX_CHANNELS]bool{IPMI_CHANNEL_IPMB: true}
+	mc.rcvQueues = [IPMI_MAX_CHANNELS][]rcvMsgT{}
+	mc.cardLastSeen = make(map[uint8]time.Time)
+}
+
+// Build a sysfs style tree of files under root
+func testTreeWrite(t *testing.T, root string, files map[string]string) {
+	for name, data := range files {
+		path := filepath.Join(root, name)
+		err := os.MkdirAll(filepath.Dir(path), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(path, []byte(data+"\n"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+var testHwmonTree = map[string]string{
+	"hwmon0/name":           "lm75",
+	"hwmon0/temp1_input":    "42000",
+	"hwmon0/temp1_max":      "80000",
+	"hwmon0/temp1_max_hyst": "75000",
+	"hwmon0/temp1_label":    "board",
+	"hwmon0/in1_input":      "12000",
+	"hwmon0/temp1_alarm":    "0",
+	// Older drivers keep their attributes under device/
+	"hwmon1/device/name":        "pmbus",
+	"hwmon1/device/curr2_input": "3000",
+	// No name, not a hwmon device
+	"hwmon2/temp1_input": "1000",
+}
+
+func TestHwmonScan(t *testing.T) {
+	root := t.TempDir()
+	testTreeWrite(t, root, testHwmonTree)
+
+	inputs, err := hwmonScan(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		chip, name, label, path string
+	}{
+		{"lm75", "in1", "", "hwmon0/in1_input"},
+		{"lm75", "temp1", "board", "hwmon0/temp1_input"},
+		{"pmbus", "curr2", "", "hwmon1/device/curr2_input"},
+	}
+	if len(inputs) != len(want) {
+		t.Fatalf("found %d inputs, want %d", len(inputs), len(want))
+	}
+	for i, w := range want {
+		in := &inputs[i]
+		if in.chip != w.chip || in.name() != w.name ||
+			in.label != w.label ||
+			in.path != filepath.Join(root, w.path) {
+			t.Errorf("input %d: got %s %s %q %s", i, in.chip,
+				in.name(), in.label, in.path)
+		}
+	}
+}
+
+func TestHwmonSensorsAdd(t *testing.T) {
+	mcTestReset(t)
+	root := t.TempDir()
+	testTreeWrite(t, root, testHwmonTree)
+
+	hwmonSensorsAdd(root)
+
+	if mc.mainSdrs.sdrCount != 3 || len(mc.sensorList) != 3 {
+		t.Fatalf("got %d sdrs, %d sensors, want 3", mc.mainSdrs.sdrCount,
+			len(mc.sensorList))
+	}
+	want := []struct {
+		id         string
+		sensorType uint8
+		slow       bool
+	}{
+		{"0lm75-in1", 0x02, false},
+		{"0board", 0x01, false},
+		{"0pmbus-curr2", 0x03, true},
+	}
+	for i, w := range want {
+		sensor := mc.sensors[0][i+1]
+		if sensor == nil || sensor.sdr == nil {
+			t.Fatalf("sensor %d: not added", i+1)
+		}
+		if sensor.sensorType != w.sensorType {
+			t.Errorf("sensor %d: type %#x, want %#x", i+1,
+				sensor.sensorType, w.sensorType)
+		}
+		if sensor.source.(*hwmonSourceT).slow != w.slow {
+			t.Errorf("sensor %d: slow %v", i+1, !w.slow)
+		}
+		record, err := UnmarshalSdr(sensor.sdr.data[:sensor.sdr.length])
+		if err != nil {
+			t.Fatal(err)
+		}
+		full, ok := record.(*FullSensorSdr)
+		if !ok {
+			t.Fatalf("sensor %d: %T sdr", i+1, record)
+		}
+		if full.Number != uint8(i+1) || full.OwnerId != mc.bmcIpmb {
+			t.Errorf("sensor %d: sdr owner %#x number %d", i+1,
+				full.OwnerId, full.Number)
+		}
+		if id := full.SdrId.Id; id != w.id {
+			t.Errorf("sensor %d: id %q, want %q", i+1, id, w.id)
+		}
+	}
+
+	// temp1 has an upper non-critical threshold with hysteresis
+	sdr := mc.sensors[0][2].sdr
+	record, _ := UnmarshalSdr(sdr.data[:sdr.length])
+	full := record.(*FullSensorSdr)
+	unc := full.RealFromRaw(full.Thresholds[THRESHOLD_UNC])
+	if math.Abs(unc-80) > 1 {
+		t.Errorf("temp1 upper non-critical %v, want 80", unc)
+	}
+	if full.ReadingMask != 0x0808 || full.PosHysteresis == 0 {
+		t.Errorf("temp1 reading mask %#x hysteresis %d",
+			full.ReadingMask, full.PosHysteresis)
+	}
+}
+
+func TestHwmonSensorNum(t *testing.T) {
+	chassisCardNum = 1
+	defer func() { chassisCardNum = 0 }()
+
+	for _, want := range []struct {
+		input    int
+		lun, num uint8
+		ok       bool
+	}{
+		{0, 0, 17, true},
+		{14, 0, 31, true},
+		{15, 1, 17, true},
+		{30, 3, 17, true}, // lun 2 is reserved
+		{44, 3, 31, true},
+		{45, 0, 0, false},
+	} {
+		lun, num, ok := hwmonSensorNum(want.input)
+		if lun != want.lun || num != want.num || ok != want.ok {
+			t.Errorf("input %d: lun %d num %d ok %v", want.input,
+				lun, num, ok)
+		}
+	}
+}
@@ -7,8 +7,10 @@ package ipmigod
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"net"
+	"sync"
 	"time"
 )
 
@@ -18,6 +20,8 @@ const (
 	PLAT_USERNAME        = "ipmiusr"
 	MAX_RETRIES          = 3
 	INITIAL_OUTBOUND_SEQ = 0x3C2FB505
+	BRIDGE_TIMEOUT       = 2 * time.Second
+	BRIDGE_TICK          = 100 * time.Millisecond
 )
 
 type csBuildMsg func(reqLen uint8) (data []uint8)
@@ -78,6 +82,28 @@ var clientCtx = clientContextT{
 	rqSeq: 1,
 }
 
+// The MM connection and clientCtx are shared by all requests to the
+// MM. Holding mmLock across building a request and reading its
+// response keeps session sequence numbers in order and responses with
+// their requests.
+var mmLock sync.Mutex
+
+// Send a request built by build to the MM, with retries
+func mmReqRsp(build func() []uint8, parsersp csParseRsp) bool {
+	mmLock.Lock()
+	defer mmLock.Unlock()
+
+	msgData := build()
+	defer mc.mmConn.SetReadDeadline(time.Time{})
+	for try := 0; try < MAX_RETRIES; try++ {
+		mc.mmConn.SetReadDeadline(time.Now().Add(BRIDGE_TIMEOUT))
+		if ipmiReqRsp(mc.mmConn, msgData, parsersp) {
+			return true
+		}
+	}
+	return false
+}
+
 // Establishes an IPMI session with remote card
 func ipmiEstablishSession(conn net.Conn) {
 
@@ -368,10 +394,10 @@ func addSdrBuildMsg(sdr *sdrT) []uint8 {
 		cmdData []uint8
 		msg     []uint8
 	)
-	cmdData = append(cmdData, sdr.data[:]...)
-	msg = clientBuildMsg(cmdData[:], uint8(len(cmdData)), 70,
-		clientCtx.sessionSeq, clientCtx.sessionId, 0, STORAGE_NETFN, 0,
-		clientCtx.rqSeq, ADD_SDR_CMD)
+	cmdData = append(cmdData, sdr.data[:sdr.length]...)
+	msg = clientBuildMsg(cmdData[:], uint8(len(cmdData)),
+		uint8(len(cmdData)+7), clientCtx.sessionSeq, clientCtx.sessionId,
+		0, STORAGE_NETFN, 0, clientCtx.rqSeq, ADD_SDR_CMD)
 	clientCtx.rqSeq++
 	clientCtx.sessionSeq++
 	if debug {
@@ -397,3 +423,172 @@ func addSdrParseRsp(data []uint8) bool {
 	}
 	return false
 }
+
+// Platform event from an LC forwarded to the MM's SEL. The sensor's
+// lun rides in rqLun so the MM can record it with the event.
+func platformEventBuildMsg(lun uint8, evData []uint8) []uint8 {
+	var (
+		cmdData []uint8
+		msg     []uint8
+	)
+	cmdData = append(cmdData, evData...)
+	msg = clientBuildMsg(cmdData[:], uint8(len(cmdData)),
+		uint8(len(cmdData)+7), clientCtx.sessionSeq, clientCtx.sessionId,
+		0, SENSOR_EVENT_NETFN, lun, clientCtx.rqSeq, PLATFORM_EVENT_CMD)
+	clientCtx.rqSeq++
+	clientCtx.sessionSeq++
+	if debug {
+		fmt.Printf("platformEventBuildMsg: % x\n", msg[:])
+	}
+
+	return msg[:]
+}
+
+func platformEventParseRsp(data []uint8) bool {
+	if clientBasicMsgCheck(data) == false {
+		fmt.Println("platformEventParseRsp basic check failed")
+		return false
+	}
+	var cmdOffset uint8 = 19
+	if data[13] == 0x08 &&
+		data[cmdOffset] == PLATFORM_EVENT_CMD &&
+		data[cmdOffset+1] == 0 {
+		if debug {
+			fmt.Println("platformEventParseRsp GOOD")
+		}
+		return true
+	}
+	return false
+}
+
+// Build a bridged request for a remote card's LAN interface. Bridged
+// requests are sent outside of a session.
+func fwdBuildMsg(rsLun uint8, netFn uint8, rqSeq uint8, cmd uint8,
+	cmdData []uint8) []uint8 {
+
+	msg := clientBuildMsg(cmdData, uint8(len(cmdData)),
+		uint8(len(cmdData)+7), 0, 0, rsLun, netFn, 0, rqSeq, cmd)
+	if debug {
+		fmt.Printf("fwdBuildMsg: % x\n", msg[:])
+	}
+
+	return msg[:]
+}
+
+// A bridged request waiting for its response. Requests are tracked by
+// sequence number so the main loop carries on in the meantime.
+type bridgeReqT struct {
+	conn    net.Conn
+	msgData []uint8 // sent again on a retry
+	tries   int
+	expires time.Time
+	done    func(rsp []uint8)
+}
+
+// A message read on a bridge connection
+type bridgeRspT struct {
+	conn net.Conn
+	data []uint8
+}
+
+var bridgeResponses = make(chan bridgeRspT, 16)
+
+// Send a bridged request. done is called from the main loop with the
+// ipmb-formatted response message (rqSA through the trailing checksum)
+// or nil if none came. Fails if all sequence numbers are in use.
+func bridgeSend(conn net.Conn, rsLun uint8, netFn uint8, cmd uint8,
+	cmdData []uint8, done func(rsp []uint8)) bool {
+
+	seq, ok := bridgeSeqAlloc()
+	if !ok {
+		return false
+	}
+	req := &bridgeReqT{conn: conn, done: done,
+		msgData: fwdBuildMsg(rsLun, netFn, seq, cmd, cmdData)}
+	mc.bridgePending[seq] = req
+	req.send()
+	return true
+}
+
+func (req *bridgeReqT) send() {
+	req.expires = time.Now().Add(BRIDGE_TIMEOUT)
+	_, err := req.conn.Write(req.msgData)
+	if err != nil {
+		fmt.Println("bridgeSend:", err)
+	}
+}
+
+// Next sequence number not used by a waiting request
+func bridgeSeqAlloc() (uint8, bool) {
+	for i := 0; i < 64; i++ {
+		seq := mc.bridgeSeq
+		mc.bridgeSeq = (mc.bridgeSeq + 1) & 0x3f
+		if mc.bridgePending[seq] == nil {
+			return seq, true
+		}
+	}
+	return 0, false
+}
+
+// Pass the messages read on a bridge connection to the main loop
+// until the connection is closed
+func bridgeRead(conn net.Conn) {
+	for {
+		data := make([]uint8, MAX_MSG_RETURN_DATA)
+		n, err := conn.Read(data)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			// e.g. refused while the remote card is down
+			if debug {
+				fmt.Println("bridgeRead:", err)
+			}
+			time.Sleep(500 * time.Millisecond)
+			continue
+		}
+		bridgeResponses <- bridgeRspT{conn, data[:n]}
+	}
+}
+
+// Hand a response to its request, called from the main loop
+func bridgeRspDone(r bridgeRspT) {
+	data := r.data
+	if len(data) < 14 || !clientBasicMsgCheck(data) {
+		fmt.Println("bridgeRspDone basic check failed")
+		return
+	}
+	msgLen := int(data[13])
+	if msgLen < 8 || 14+msgLen > len(data) {
+		fmt.Println("bridgeRspDone: bad message length", msgLen)
+		return
+	}
+	seq := data[18] >> 2
+	req := mc.bridgePending[seq]
+	if req == nil || req.conn != r.conn {
+		if debug {
+			fmt.Println("bridgeRspDone: no request for seq", seq)
+		}
+		return
+	}
+	delete(mc.bridgePending, seq)
+	req.done(data[14 : 14+msgLen])
+}
+
+// Resend requests that timed out, giving up after MAX_RETRIES tries.
+// Called from the main loop every BRIDGE_TICK.
+func bridgeExpire() {
+	now := time.Now()
+	for seq, req := range mc.bridgePending {
+		if now.Before(req.expires) {
+			continue
+		}
+		req.tries++
+		if req.tries < MAX_RETRIES {
+			req.send()
+			continue
+		}
+		delete(mc.bridgePending, seq)
+		req.done(nil)
+	}
+}
@@ -9,14 +9,35 @@ import (
 	"encoding/binary"
 	"fmt"
 	"math/rand"
+	"net"
 )
 
 const (
 	USER_BITS_REQ = 6
 	USER_MASK     = 0x3f
+
+	IPMB_BASE_ADDR        = 0x20
+	MAX_BRIDGE_MSG_LENGTH = 200
+	MAX_RCV_MSGS          = 16
 )
 
 func getDeviceId(msg *msgT) {
+	var data [12]uint8
+
+	data[0] = 0
+	data[1] = mc.deviceId
+	data[2] = mc.deviceRevision & 0xf
+	if mc.hasDeviceSdrs {
+		data[2] |= 0x80
+	}
+	data[3] = mc.majorFwRev & 0x7f
+	data[4] = mc.minorFwRev
+	data[5] = 0x02 // IPMI 2.0
+	data[6] = mc.deviceSupport
+	copy(data[7:10], mc.mfgId[:])
+	copy(data[10:12], mc.productId[:])
+
+	msg.returnRspData(nil, data[0:12], 12)
 }
 
 func coldReset(msg *msgT) {
@@ -56,18 +77,240 @@ func getBmcGlobalEnables(msg *msgT) {
 }
 
 func clearMsgFlags(msg *msgT) {
+	var data [1]uint8
+
+	// Only the receive message queue flag is supported
+	if msg.data[msg.dataStart]&0x1 != 0 {
+		for channel := range mc.rcvQueues {
+			mc.rcvQueues[channel] = nil
+		}
+	}
+
+	data[0] = 0
+	msg.returnRspData(nil, data[0:1], 1)
 }
 
 func getMsgFlagsCmd(msg *msgT) {
+	var data [2]uint8
+
+	data[0] = 0
+	data[1] = 0
+	for channel := range mc.rcvQueues {
+		if len(mc.rcvQueues[channel]) > 0 {
+			data[1] |= 0x1 // receive message available
+			break
+		}
+	}
+
+	msg.returnRspData(nil, data[0:2], 2)
 }
 
 func enableMessageChannelRcv(msg *msgT) {
+	var data [3]uint8
+
+	dataStart := msg.dataStart
+	channel := msg.data[dataStart] & 0xf
+	if channel == IPMI_CHANNEL_CURRENT {
+		channel = msg.channel
+	}
+
+	switch msg.data[dataStart+1] & 0x3 {
+	case 0:
+		mc.rcvEnabled[channel] = false
+		mc.rcvQueues[channel] = nil
+	case 1:
+		mc.rcvEnabled[channel] = true
+	case 2:
+		// Just report the current state
+	default:
+		msg.returnErr(nil, IPMI_INVALID_DATA_FIELD_CC)
+		return
+	}
+
+	data[0] = 0
+	data[1] = channel
+	if mc.rcvEnabled[channel] {
+		data[2] = 1
+	}
+	msg.returnRspData(nil, data[0:3], 3)
 }
 
 func getMsg(msg *msgT) {
+	var data [MAX_MSG_RETURN_DATA]uint8
+
+	for channel := range mc.rcvQueues {
+		if len(mc.rcvQueues[channel]) == 0 {
+			continue
+		}
+		rcvMsg := mc.rcvQueues[channel][0]
+		mc.rcvQueues[channel] = mc.rcvQueues[channel][1:]
+
+		data[0] = 0
+		data[1] = (rcvMsg.priv << 4) | rcvMsg.channel
+		copy(data[2:], rcvMsg.data)
+		msg.returnRspData(nil, data[0:], uint(len(rcvMsg.data)+2))
+		return
+	}
+
+	msg.returnErr(nil, 0x80) // Data not available (queue empty)
 }
 
+// Address of a card's BMC on the chassis IPMB
+func cardIpmbAddr(card uint8) uint8 {
+	return IPMB_BASE_ADDR + (card << 1)
+}
+
+// Chassis internal network the LCs reach the MM on. Only requests from
+// there may say where bridged traffic for a card goes.
+var ChassisNet string = "10.0.0.0/24"
+
+func lcAddrKnown(addr *net.UDPAddr) bool {
+	_, lcNet, err := net.ParseCIDR(ChassisNet)
+	if err != nil || addr == nil {
+		return false
+	}
+	return lcNet.Contains(addr.IP)
+}
+
+// Record the lan service of the LC behind an ipmb address. The MM
+// learns these from the addSdr traffic each LC sends at startup; sdrs
+// added from outside the chassis network don't move a route.
+func ipmbRouteAdd(card uint8, addr *net.UDPAddr) {
+	if !lcAddrKnown(addr) {
+		if debug {
+			fmt.Println("ipmbRouteAdd: ignoring", addr, "for card",
+				card)
+		}
+		return
+	}
+	ipmbAddr := cardIpmbAddr(card)
+	service := net.JoinHostPort(addr.IP.String(), "623")
+
+	if mc.ipmbRoutes[ipmbAddr] == service {
+		return
+	}
+	if conn := mc.ipmbConns[ipmbAddr]; conn != nil {
+		conn.Close()
+		delete(mc.ipmbConns, ipmbAddr)
+	}
+	mc.ipmbRoutes[ipmbAddr] = service
+	if debug {
+		fmt.Printf("ipmb route %x -> %s\n", ipmbAddr, service)
+	}
+}
+
+func ipmbConn(ipmbAddr uint8) net.Conn {
+	if conn := mc.ipmbConns[ipmbAddr]; conn != nil {
+		return conn
+	}
+
+	service, ok := mc.ipmbRoutes[ipmbAddr]
+	if !ok {
+		return nil
+	}
+	conn, err := net.Dial("udp", service)
+	if err != nil {
+		fmt.Println("ipmbConn: could not connect to", service, err)
+		return nil
+	}
+	mc.ipmbConns[ipmbAddr] = conn
+	go bridgeRead(conn)
+	return conn
+}
+
+// The request is passed on and the main loop carries on, the response
+// comes back through the done callback. Without tracking the Send
+// Message response goes right away and the bridged response is queued
+// for Get Message.
 func sendMsg(msg *msgT) {
+	var data [1]uint8
+
+	// Request data holds the channel byte followed by an ipmb request
+	// message.
+	dataStart := msg.dataStart
+	reqLen := msg.reqDataLen()
+	if reqLen < 8 || reqLen-1 > MAX_BRIDGE_MSG_LENGTH {
+		msg.returnErr(nil, IPMI_REQUEST_DATA_LENGTH_INVALID_CC)
+		return
+	}
+	ipmb := msg.data[dataStart+1 : dataStart+reqLen]
+
+	channel := msg.data[dataStart] & 0xf
+	tracking := msg.data[dataStart] >> 6
+	if channel == IPMI_CHANNEL_CURRENT {
+		channel = msg.channel
+	}
+	if channel != IPMI_CHANNEL_IPMB || tracking == 3 {
+		fmt.Println("sendMsg: unsupported channel/tracking",
+			channel, tracking)
+		msg.returnErr(nil, IPMI_INVALID_DATA_FIELD_CC)
+		return
+	}
+	if ipmiChecksum(ipmb[0:3], 3, 0) != 0 ||
+		ipmiChecksum(ipmb[3:], len(ipmb)-3, 0) != 0 {
+		fmt.Println("sendMsg: bad encapsulated checksum")
+		msg.returnErr(nil, IPMI_INVALID_DATA_FIELD_CC)
+		return
+	}
+
+	rsAddr := ipmb[0]
+	netFn := ipmb[1] >> 2
+	rsLun := ipmb[1] & 0x3
+	rqAddr := ipmb[3]
+	rqSeq := ipmb[4] >> 2
+	rqLun := ipmb[4] & 0x3
+	cmd := ipmb[5]
+
+	conn := ipmbConn(rsAddr)
+	if conn == nil {
+		fmt.Printf("sendMsg: no route to ipmb %x\n", rsAddr)
+		msg.returnErr(nil, IPMI_DESTINATION_UNAVAILABLE_CC)
+		return
+	}
+
+	done := func(rsp []uint8) {
+		if rsp == nil {
+			fmt.Printf("sendMsg: no response from ipmb %x\n",
+				rsAddr)
+			if tracking == 1 {
+				msg.returnErr(nil, IPMI_TIMEOUT_CC)
+			}
+			return
+		}
+
+		// Readdress the response to the original requester
+		rsp[0] = rqAddr
+		rsp[1] = (rsp[1] &^ 0x3) | rqLun
+		rsp[2] = uint8(ipmiChecksum(rsp[0:2], 2, 0))
+		rsp[3] = rsAddr
+		rsp[4] = (rqSeq << 2) | rsLun
+		rsp[len(rsp)-1] = uint8(ipmiChecksum(rsp[3:len(rsp)-1],
+			len(rsp)-4, 0))
+
+		if tracking == 1 {
+			// Deliver response inline
+			rspData := append([]uint8{0}, rsp...)
+			msg.returnRspData(nil, rspData, uint(len(rspData)))
+			return
+		}
+		if mc.rcvEnabled[channel] &&
+			len(mc.rcvQueues[channel]) < MAX_RCV_MSGS {
+			mc.rcvQueues[channel] = append(mc.rcvQueues[channel],
+				rcvMsgT{channel: channel, data: rsp})
+		} else if debug {
+			fmt.Println("sendMsg: dropped response on channel",
+				channel)
+		}
+	}
+	if !bridgeSend(conn, rsLun, netFn, cmd, ipmb[6:len(ipmb)-1], done) {
+		msg.returnErr(nil, IPMI_NODE_BUSY_CC)
+		return
+	}
+
+	if tracking != 1 {
+		data[0] = 0
+		msg.returnRspData(nil, data[0:1], 1)
+	}
 }
 
 func readEventMsgBuffer(msg *msgT) {
@@ -0,0 +1,182 @@
+// Copyright 2015 Platina Systems, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style license described in the
+// LICENSE file.
+
+// Package contains IPMI 2.0 spec protocol definitions
+package ipmigod
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// Stand in for the LC at ipmb address rsAddr, answering requests with
+// rsp unless it's nil. Returns the requests received.
+func testLcStart(t *testing.T, rsAddr uint8, rsp []uint8) <-chan []uint8 {
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	lc, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { lc.Close() })
+	mc.ipmbRoutes[rsAddr] = lc.LocalAddr().String()
+
+	received := make(chan []uint8, 16)
+	go func() {
+		for {
+			req := make([]uint8, MAX_MSG_RETURN_DATA)
+			n, addr, err := lc.ReadFromUDP(req)
+			if err != nil {
+				return
+			}
+			received <- req[:n]
+			if rsp == nil {
+				continue
+			}
+			n = len(rsp)
+			netFn := (req[15] >> 2) | 1
+			lc.WriteToUDP(clientBuildMsg(rsp, uint8(n), uint8(n+7),
+				0, 0, 0, netFn, 0, req[18]>>2, req[19]), addr)
+		}
+	}()
+	return received
+}
+
+// An ipmb request message as carried by Send Message
+func testIpmbBuild(rsAddr uint8, netFn uint8, seq uint8, cmd uint8,
+	req []uint8) []uint8 {
+
+	ipmb := []uint8{rsAddr, netFn << 2, 0, 0x81, seq << 2, cmd}
+	ipmb[2] = uint8(ipmiChecksum(ipmb[0:2], 2, 0))
+	ipmb = append(ipmb, req...)
+	return append(ipmb, uint8(ipmiChecksum(ipmb[3:], len(ipmb)-3, 0)))
+}
+
+// Run the bridged request timeouts as the main loop would
+func testBridgeExpire() {
+	for try := 0; try < MAX_RETRIES; try++ {
+		for _, req := range mc.bridgePending {
+			req.expires = time.Time{}
+		}
+		bridgeExpire()
+	}
+}
+
+// Send Message passes a request on to the LC without holding up the
+// main loop. The LC's response comes back inline when tracked,
+// otherwise it's queued for Get Message.
+func TestSendMsg(t *testing.T) {
+	lcAddr := cardIpmbAddr(2)
+
+	for _, c := range []struct {
+		name     string
+		tracking uint8
+		lcRsp    []uint8
+		cc       uint8
+	}{
+		{"tracked", 1, []uint8{0, 0x51}, 0},
+		{"queued", 0, []uint8{0, 0x51}, 0},
+		{"tracked timeout", 1, nil, IPMI_TIMEOUT_CC},
+		{"queued timeout", 0, nil, 0},
+	} {
+		mcTestReset(t)
+		received := testLcStart(t, lcAddr, c.lcRsp)
+
+		ipmb := testIpmbBuild(lcAddr, APP_NETFN, 9, GET_DEVICE_ID_CMD,
+			nil)
+		req := append([]uint8{c.tracking<<6 | IPMI_CHANNEL_IPMB},
+			ipmb...)
+		msg, client := testMsgStart(t, testMsgBuild(APP_NETFN,
+			SEND_MSG_CMD, req))
+		sendMsg(msg)
+
+		// The Send Message response doesn't wait for the LC
+		var rsp []uint8
+		if c.tracking == 0 {
+			rsp = testMsgRsp(t, client)
+			if rsp[0] != 0 || len(rsp) != 1 {
+				t.Errorf("%s: response % x", c.name, rsp)
+			}
+		}
+		lcReq := <-received
+		if lcReq[19] != GET_DEVICE_ID_CMD ||
+			mc.bridgePending[lcReq[18]>>2] == nil {
+			t.Fatalf("%s: LC got % x", c.name, lcReq)
+		}
+		if c.lcRsp != nil {
+			bridgeRspDone(<-bridgeResponses)
+		} else {
+			testBridgeExpire()
+			for try := 1; try < MAX_RETRIES; try++ {
+				select {
+				case <-received:
+				case <-time.After(BRIDGE_TIMEOUT):
+					t.Errorf("%s: sent %d times", c.name,
+						try)
+				}
+			}
+		}
+		if len(mc.bridgePending) != 0 {
+			t.Errorf("%s: request still pending", c.name)
+		}
+
+		if c.tracking == 1 {
+			rsp = testMsgRsp(t, client)
+			if rsp[0] != c.cc {
+				t.Errorf("%s: completion code %#x", c.name,
+					rsp[0])
+			}
+			if c.cc == 0 {
+				testIpmbRspCheck(t, c.name, rsp[1:], lcAddr,
+					c.lcRsp)
+			}
+			continue
+		}
+
+		rsp = testMsgRun(t, testMsgBuild(APP_NETFN, GET_MSG_CMD, nil),
+			getMsg)
+		if c.lcRsp == nil {
+			if rsp[0] != 0x80 {
+				t.Errorf("%s: get message % x", c.name, rsp)
+			}
+			continue
+		}
+		if rsp[0] != 0 || rsp[1] != IPMI_CHANNEL_IPMB {
+			t.Fatalf("%s: get message % x", c.name, rsp)
+		}
+		testIpmbRspCheck(t, c.name, rsp[2:], lcAddr, c.lcRsp)
+	}
+}
+
+// The response is addressed back to the original requester
+func testIpmbRspCheck(t *testing.T, name string, rsp []uint8,
+	rsAddr uint8, data []uint8) {
+
+	if len(rsp) != 7+len(data) || rsp[0] != 0x81 ||
+		rsp[1] != (APP_NETFN|1)<<2 || rsp[3] != rsAddr ||
+		rsp[4] != 9<<2 || rsp[5] != GET_DEVICE_ID_CMD ||
+		string(rsp[6:len(rsp)-1]) != string(data) ||
+		ipmiChecksum(rsp[0:3], 3, 0) != 0 ||
+		ipmiChecksum(rsp[3:], len(rsp)-3, 0) != 0 {
+		t.Errorf("%s: ipmb response % x", name, rsp)
+	}
+}
+
+// Requests wait for their responses under their own sequence numbers
+func TestBridgeSeqAlloc(t *testing.T) {
+	mcTestReset(t)
+	mc.bridgeSeq = 63
+	for seq := uint8(0); seq < 64; seq++ {
+		if seq != 5 {
+			mc.bridgePending[seq] = &bridgeReqT{}
+		}
+	}
+	if seq, ok := bridgeSeqAlloc(); !ok || seq != 5 {
+		t.Errorf("seq %d ok %v", seq, ok)
+	}
+	mc.bridgePending[5] = &bridgeReqT{}
+	if _, ok := bridgeSeqAlloc(); ok {
+		t.Error("seq allocated with all in use")
+	}
+}
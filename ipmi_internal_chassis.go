@@ -5,29 +5,257 @@
 // Package contains IPMI 2.0 spec protocol definitions
 package ipmigod
 
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
 func getChassisCapabilities(msg *msgT) {
 }
 
+func getChassisStatus(msg *msgT) {
+	var data [4]uint8
+
+	on, err := mc.chassis.driver.powerState()
+	if err != nil {
+		fmt.Println("getChassisStatus:", err)
+		msg.returnErr(nil, IPMI_UNKNOWN_ERR_CC)
+		return
+	}
+
+	chassisPowerOnUpdate(on)
+
+	data[0] = 0
+	if on {
+		data[1] |= 0x01
+	}
+	if mc.chassis.powerFault {
+		data[1] |= 0x08
+	}
+	if mc.chassis.powerControlFault {
+		data[1] |= 0x10
+	}
+	data[1] |= (mc.chassis.restorePolicy & 0x3) << 5
+	data[2] = mc.chassis.lastPowerEvent
+	if mc.chassis.driveFault {
+		data[3] |= 0x04
+	}
+	if mc.chassis.coolingFault {
+		data[3] |= 0x08
+	}
+	// Identify command and state info supported
+	data[3] |= 0x40 | (mc.chassis.identifyState << 4)
+
+	msg.returnRspData(nil, data[0:4], 4)
+}
+
 func chassisControl(msg *msgT) {
+
+	if msg.reqDataLen() < 1 {
+		msg.returnErr(nil, IPMI_REQUEST_DATA_LENGTH_INVALID_CC)
+		return
+	}
+	action := msg.data[msg.dataStart] & 0xf
+	if action > CHASSIS_SOFT_SHUTDOWN {
+		msg.returnErr(nil, IPMI_INVALID_DATA_FIELD_CC)
+		return
+	}
+
+	on, err := mc.chassis.driver.powerState()
+	if err != nil {
+		fmt.Println("chassisControl:", err)
+		msg.returnErr(nil, IPMI_UNKNOWN_ERR_CC)
+		return
+	}
+
+	// Only power up/down make sense for a powered down chassis
+	if !on && action != CHASSIS_POWER_UP &&
+		action != CHASSIS_POWER_DOWN {
+		msg.returnErr(nil, IPMI_NOT_SUPPORTED_IN_PRESENT_STATE_CC)
+		return
+	}
+
+	err = mc.chassis.driver.control(action)
+	if err != nil {
+		fmt.Println("chassisControl:", err)
+		mc.chassis.powerControlFault = true
+		msg.returnErr(nil, IPMI_UNKNOWN_ERR_CC)
+		return
+	}
+	mc.chassis.powerControlFault = false
+	switch action {
+	case CHASSIS_POWER_UP, CHASSIS_POWER_CYCLE:
+		// Power is on via ipmi command
+		mc.chassis.lastPowerEvent = 0x10
+		chassisButtonPress(BUTTON_POWER)
+		chassisRestartCauseSet(RESTART_CAUSE_CHASSIS_CONTROL,
+			msg.channel)
+		chassisPowerOnUpdate(true)
+	case CHASSIS_HARD_RESET:
+		chassisButtonPress(BUTTON_RESET)
+		chassisRestartCauseSet(RESTART_CAUSE_CHASSIS_CONTROL,
+			msg.channel)
+	case CHASSIS_POWER_DOWN, CHASSIS_SOFT_SHUTDOWN:
+		chassisButtonPress(BUTTON_POWER)
+		chassisPowerOnUpdate(false)
+	}
+
+	msg.returnErr(nil, 0)
 }
 
 func chassisReset(msg *msgT) {
 }
 
+// Switch the identify indicator into state. A timed state is turned
+// off after interval by the main loop, see chassisIdentifyExpired.
+func chassisIdentifySet(state uint8, interval time.Duration) error {
+	if mc.chassis.identifyTimer != nil {
+		mc.chassis.identifyTimer.Stop()
+		mc.chassis.identifyTimer = nil
+	}
+
+	err := mc.chassis.identify.setIdentify(state != IDENTIFY_OFF)
+	if err != nil {
+		return err
+	}
+	mc.chassis.identifyState = state
+
+	if state == IDENTIFY_TIMED_ON {
+		mc.chassis.identifyTimer = time.NewTimer(interval)
+	}
+	return nil
+}
+
+func chassisIdentifyExpired() {
+	mc.chassis.identifyTimer = nil
+	mc.chassis.identifyState = IDENTIFY_OFF
+	err := mc.chassis.identify.setIdentify(false)
+	if err != nil {
+		fmt.Println("chassisIdentify:", err)
+	}
+}
+
 func chassisIdentify(msg *msgT) {
+	var (
+		state    uint8
+		interval time.Duration
+	)
+
+	// Both the interval and force bytes are optional
+	dataStart := msg.dataStart
+	reqLen := msg.reqDataLen()
+	state = IDENTIFY_TIMED_ON
+	interval = IDENTIFY_DEFAULT_ON
+	if reqLen > 0 {
+		interval = time.Duration(msg.data[dataStart]) * time.Second
+		if interval == 0 {
+			state = IDENTIFY_OFF
+		}
+	}
+	if reqLen > 1 && msg.data[dataStart+1]&0x1 != 0 {
+		state = IDENTIFY_FORCED_ON
+	}
+
+	err := chassisIdentifySet(state, interval)
+	if err != nil {
+		fmt.Println("chassisIdentify:", err)
+		msg.returnErr(nil, IPMI_UNKNOWN_ERR_CC)
+		return
+	}
+
+	msg.returnErr(nil, 0)
 }
 
 func setChassisCapabilities(msg *msgT) {
 }
 
 func setPowerRestorePolicy(msg *msgT) {
+	var data [2]uint8
+
+	if msg.reqDataLen() < 1 {
+		msg.returnErr(nil, IPMI_REQUEST_DATA_LENGTH_INVALID_CC)
+		return
+	}
+	policy := msg.data[msg.dataStart] & 0x7
+	if policy > POWER_RESTORE_UNKNOWN {
+		msg.returnErr(nil, IPMI_INVALID_DATA_FIELD_CC)
+		return
+	}
+	// Policy 3 means no change, just report what is supported
+	if policy != POWER_RESTORE_UNKNOWN &&
+		policy != mc.chassis.restorePolicy {
+		mc.chassis.restorePolicy = policy
+		chassisSave()
+	}
+
+	data[0] = 0
+	data[1] = (1 << POWER_RESTORE_ALWAYS_OFF) |
+		(1 << POWER_RESTORE_PREVIOUS) |
+		(1 << POWER_RESTORE_ALWAYS_ON)
+	msg.returnRspData(nil, data[0:2], 2)
 }
 
 func getSystemRestartCause(msg *msgT) {
+	var data [3]uint8
+
+	data[0] = 0
+	data[1] = mc.chassis.restartCause & 0xf
+	data[2] = mc.chassis.restartChannel
+	msg.returnRspData(nil, data[0:3], 3)
 }
 
 func setSystemBootOptions(msg *msgT) {
+
+	reqLen := msg.reqDataLen()
+	if reqLen < 1 {
+		msg.returnErr(nil, IPMI_REQUEST_DATA_LENGTH_INVALID_CC)
+		return
+	}
+
+	dataStart := msg.dataStart
+	param := msg.data[dataStart] & 0x7f
+	locked := msg.data[dataStart]&0x80 != 0
+	cc := bootOptSet(param, locked,
+		msg.data[dataStart+1:dataStart+reqLen])
+
+	msg.returnErr(nil, cc)
 }
 
 func getSystemBootOptions(msg *msgT) {
+	var data [MAX_MSG_RETURN_DATA]uint8
+
+	// Parameter, set and block selectors
+	if msg.reqDataLen() < 3 {
+		msg.returnErr(nil, IPMI_REQUEST_DATA_LENGTH_INVALID_CC)
+		return
+	}
+	dataStart := msg.dataStart
+	param := msg.data[dataStart] & 0x7f
+	setSel := msg.data[dataStart+1]
+
+	optData, cc := bootOptGet(param, setSel)
+	if cc != 0 {
+		msg.returnErr(nil, cc)
+		return
+	}
+
+	data[0] = 0
+	data[1] = BOOT_OPT_PARAM_VERSION
+	data[2] = param
+	if bootOpts.Locked[param] {
+		data[2] |= 0x80
+	}
+	copy(data[3:], optData)
+	msg.returnRspData(nil, data[0:], uint(len(optData)+3))
+}
+
+func getPohCounter(msg *msgT) {
+	var data [6]uint8
+
+	data[0] = 0
+	data[1] = POH_MINUTES_PER_COUNT
+	binary.LittleEndian.PutUint32(data[2:6],
+		mc.chassis.pohMinutes/POH_MINUTES_PER_COUNT)
+	msg.returnRspData(nil, data[0:6], 6)
 }
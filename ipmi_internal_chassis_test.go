@@ -0,0 +1,339 @@
+// Copyright 2015 Platina Systems, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style license described in the
+// LICENSE file.
+
+// Package contains IPMI 2.0 spec implementation
+package ipmigod
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func testChassisControl(t *testing.T, action uint8) {
+	rsp := testMsgRun(t, testMsgBuild(CHASSIS_NETFN, CHASSIS_CONTROL_CMD,
+		[]uint8{action}), chassisControl)
+	if rsp[0] != 0 {
+		t.Errorf("action %d: completion code %#x", action, rsp[0])
+	}
+}
+
+// Restarts and chassis controls log sensor-specific events from the
+// watchdog and button sensors
+func TestChassisSensorEvents(t *testing.T) {
+	type event struct {
+		sensorType uint8
+		dir        uint8
+		offset     uint8
+	}
+	defer func(root string) { powerSupplyRoot = root }(powerSupplyRoot)
+
+	for _, c := range []struct {
+		name   string
+		change func()
+		events []event
+	}{
+		{"watchdog restart", func() {
+			chassisRestartCauseSet(RESTART_CAUSE_WATCHDOG, 0)
+		}, []event{
+			{SENSOR_TYPE_WATCHDOG_2, 0, WATCHDOG_HARD_RESET},
+		}},
+		{"other restart", func() {
+			chassisRestartCauseSet(RESTART_CAUSE_WATCHDOG, 0)
+			chassisRestartCauseSet(RESTART_CAUSE_CHASSIS_CONTROL, 0)
+		}, []event{
+			{SENSOR_TYPE_WATCHDOG_2, 0, WATCHDOG_HARD_RESET},
+			{SENSOR_TYPE_WATCHDOG_2, EVENT_DIR_DEASSERTION,
+				WATCHDOG_HARD_RESET},
+		}},
+		{"hard reset", func() {
+			testChassisControl(t, CHASSIS_HARD_RESET)
+		}, []event{
+			{SENSOR_TYPE_BUTTON, 0, BUTTON_RESET},
+			{SENSOR_TYPE_BUTTON, EVENT_DIR_DEASSERTION,
+				BUTTON_RESET},
+		}},
+		{"power down", func() {
+			testChassisControl(t, CHASSIS_POWER_DOWN)
+		}, []event{
+			{SENSOR_TYPE_BUTTON, 0, BUTTON_POWER},
+			{SENSOR_TYPE_BUTTON, EVENT_DIR_DEASSERTION,
+				BUTTON_POWER},
+		}},
+	} {
+		mcTestReset(t)
+		powerSupplyRoot = t.TempDir()
+		discreteSensorsAdd()
+
+		c.change()
+		if int(mc.sel.count) != len(c.events) {
+			t.Errorf("%s: %d events", c.name, mc.sel.count)
+			continue
+		}
+		for i, e := range c.events {
+			record := mc.sel.entries[i].data
+			if record[10] != e.sensorType ||
+				record[12] != e.dir|SENSOR_SPECIFIC_READING_TYPE ||
+				record[13] != e.offset {
+				t.Errorf("%s: event % x", c.name, record[7:])
+			}
+		}
+	}
+}
+
+// A timed identify is turned off from the main loop when its timer
+// fires, a later identify replaces the timer
+func TestChassisIdentifyTimer(t *testing.T) {
+	mcTestReset(t)
+
+	if err := chassisIdentifySet(IDENTIFY_TIMED_ON, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := chassisIdentifySet(IDENTIFY_TIMED_ON,
+		time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	<-timerChan(mc.chassis.identifyTimer)
+	chassisIdentifyExpired()
+	if mc.chassis.identifyState != IDENTIFY_OFF ||
+		timerChan(mc.chassis.identifyTimer) != nil {
+		t.Errorf("identify state %d", mc.chassis.identifyState)
+	}
+
+	if err := chassisIdentifySet(IDENTIFY_FORCED_ON, 0); err != nil {
+		t.Fatal(err)
+	}
+	if mc.chassis.identifyTimer != nil {
+		t.Error("forced identify timed")
+	}
+}
+
+// Power-on minutes only count while the chassis is on and are saved
+// every POH_SAVE_MINUTES
+func TestChassisPohTick(t *testing.T) {
+	mcTestReset(t)
+	driver := &simChassisDriver{on: true}
+	mc.chassis.driver = driver
+	mc.chassis.powerOn = true
+
+	for i := 0; i < POH_SAVE_MINUTES; i++ {
+		chassisPohTick()
+	}
+	driver.on = false
+	chassisPohTick()
+
+	if mc.chassis.pohMinutes != POH_SAVE_MINUTES || mc.chassis.powerOn {
+		t.Errorf("%d minutes, on %v", mc.chassis.pohMinutes,
+			mc.chassis.powerOn)
+	}
+	mc.chassis.pohMinutes = 0
+	chassisLoad()
+	if mc.chassis.pohMinutes != POH_SAVE_MINUTES {
+		t.Errorf("%d minutes saved", mc.chassis.pohMinutes)
+	}
+}
+
+// Counts are whole hours and survive a BMC restart
+func TestGetPohCounter(t *testing.T) {
+	for _, c := range []struct {
+		minutes uint32
+		count   uint32
+	}{
+		{0, 0},
+		{POH_MINUTES_PER_COUNT - 1, 0},
+		{POH_MINUTES_PER_COUNT, 1},
+		{25*POH_MINUTES_PER_COUNT + 7, 25},
+		{0xffffffff, 0xffffffff / POH_MINUTES_PER_COUNT},
+	} {
+		mcTestReset(t)
+		mc.chassis.pohMinutes = c.minutes
+		chassisSave()
+		mc.chassis.pohMinutes = 0
+		chassisLoad()
+
+		rsp := testMsgRun(t, testMsgBuild(CHASSIS_NETFN,
+			GET_POH_COUNTER_CMD, nil), getPohCounter)
+		if len(rsp) != 6 || rsp[0] != 0 ||
+			rsp[1] != POH_MINUTES_PER_COUNT ||
+			binary.LittleEndian.Uint32(rsp[2:]) != c.count {
+			t.Errorf("%d minutes: response % x", c.minutes, rsp)
+		}
+	}
+}
+
+func TestChassisControl(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		on    bool
+		req   []uint8
+		cc    uint8
+		after bool
+	}{
+		{"no action", true, nil, IPMI_REQUEST_DATA_LENGTH_INVALID_CC,
+			true},
+		{"bad action", true, []uint8{CHASSIS_SOFT_SHUTDOWN + 1},
+			IPMI_INVALID_DATA_FIELD_CC, true},
+		{"power down", true, []uint8{CHASSIS_POWER_DOWN}, 0, false},
+		{"power up", false, []uint8{CHASSIS_POWER_UP}, 0, true},
+		{"cycle when off", false, []uint8{CHASSIS_POWER_CYCLE},
+			IPMI_NOT_SUPPORTED_IN_PRESENT_STATE_CC, false},
+		{"hard reset", true, []uint8{CHASSIS_HARD_RESET}, 0, true},
+	} {
+		mcTestReset(t)
+		driver := &simChassisDriver{on: c.on}
+		mc.chassis.driver = driver
+		mc.chassis.powerOn = c.on
+
+		rsp := testMsgRun(t, testMsgBuild(CHASSIS_NETFN,
+			CHASSIS_CONTROL_CMD, c.req), chassisControl)
+		if rsp[0] != c.cc || driver.on != c.after {
+			t.Errorf("%s: completion code %#x, on %v", c.name,
+				rsp[0], driver.on)
+			continue
+		}
+
+		// The power state and restart cause survive a restart
+		mc.chassis = chassisT{}
+		chassisLoad()
+		cause := uint8(RESTART_CAUSE_UNKNOWN)
+		if c.cc == 0 && c.after {
+			cause = RESTART_CAUSE_CHASSIS_CONTROL
+		}
+		if (c.cc == 0 && mc.chassis.powerOn != c.after) ||
+			mc.chassis.restartCause != cause {
+			t.Errorf("%s: saved on %v cause %d", c.name,
+				mc.chassis.powerOn, mc.chassis.restartCause)
+		}
+	}
+}
+
+func TestGetChassisStatus(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		set    func()
+		status [3]uint8
+	}{
+		{"off", func() {
+			mc.chassis.driver = &simChassisDriver{}
+		}, [3]uint8{0x00, 0, 0x40}},
+		{"on, always on", func() {
+			mc.chassis.restorePolicy = POWER_RESTORE_ALWAYS_ON
+		}, [3]uint8{0x41, 0, 0x40}},
+		{"faults", func() {
+			mc.chassis.powerFault = true
+			mc.chassis.powerControlFault = true
+			mc.chassis.coolingFault = true
+			mc.chassis.driveFault = true
+		}, [3]uint8{0x19, 0, 0x4c}},
+		{"identify", func() {
+			mc.chassis.identifyState = IDENTIFY_FORCED_ON
+			mc.chassis.lastPowerEvent = 0x10
+		}, [3]uint8{0x01, 0x10, 0x60}},
+	} {
+		mcTestReset(t)
+		c.set()
+		rsp := testMsgRun(t, testMsgBuild(CHASSIS_NETFN,
+			GET_CHASSIS_STATUS_CMD, nil), getChassisStatus)
+		if len(rsp) != 4 || rsp[0] != 0 ||
+			[3]uint8{rsp[1], rsp[2], rsp[3]} != c.status {
+			t.Errorf("%s: response % x", c.name, rsp)
+		}
+	}
+}
+
+// The policy set is reported by Get Chassis Status and kept across
+// restarts
+func TestSetPowerRestorePolicy(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		req    []uint8
+		cc     uint8
+		policy uint8
+	}{
+		{"no policy", nil, IPMI_REQUEST_DATA_LENGTH_INVALID_CC,
+			POWER_RESTORE_PREVIOUS},
+		{"bad policy", []uint8{4}, IPMI_INVALID_DATA_FIELD_CC,
+			POWER_RESTORE_PREVIOUS},
+		{"always off", []uint8{POWER_RESTORE_ALWAYS_OFF}, 0,
+			POWER_RESTORE_ALWAYS_OFF},
+		{"always on", []uint8{POWER_RESTORE_ALWAYS_ON}, 0,
+			POWER_RESTORE_ALWAYS_ON},
+		{"no change", []uint8{POWER_RESTORE_UNKNOWN}, 0,
+			POWER_RESTORE_PREVIOUS},
+	} {
+		mcTestReset(t)
+		chassisLoad()
+		rsp := testMsgRun(t, testMsgBuild(CHASSIS_NETFN,
+			SET_POWER_RESTORE_POLICY_CMD, c.req),
+			setPowerRestorePolicy)
+		if rsp[0] != c.cc || (c.cc == 0 && rsp[1] != 0x07) {
+			t.Errorf("%s: response % x", c.name, rsp)
+		}
+
+		mc.chassis = chassisT{}
+		chassisLoad()
+		if mc.chassis.restorePolicy != c.policy {
+			t.Errorf("%s: policy %d after restart", c.name,
+				mc.chassis.restorePolicy)
+		}
+	}
+}
+
+// The cause of the last restart and its channel survive a restart
+func TestGetSystemRestartCause(t *testing.T) {
+	for _, c := range []struct {
+		cause   uint8
+		channel uint8
+	}{
+		{RESTART_CAUSE_CHASSIS_CONTROL, 1},
+		{RESTART_CAUSE_RESTORE_ALWAYS, 0},
+		{RESTART_CAUSE_WATCHDOG, 0},
+	} {
+		mcTestReset(t)
+		chassisRestartCauseSet(c.cause, c.channel)
+		mc.chassis = chassisT{}
+		chassisLoad()
+
+		rsp := testMsgRun(t, testMsgBuild(CHASSIS_NETFN,
+			GET_SYSTEM_RESTART_CAUSE_CMD, nil), getSystemRestartCause)
+		if len(rsp) != 3 || rsp[0] != 0 || rsp[1] != c.cause ||
+			rsp[2] != c.channel {
+			t.Errorf("cause %d: response % x", c.cause, rsp)
+		}
+	}
+}
+
+// The restore policy decides whether a chassis found off at startup is
+// powered up
+func TestChassisPowerRestore(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		policy uint8
+		wasOn  bool
+		on     bool
+		cause  uint8
+	}{
+		{"always off", POWER_RESTORE_ALWAYS_OFF, true, false,
+			RESTART_CAUSE_UNKNOWN},
+		{"always on", POWER_RESTORE_ALWAYS_ON, false, true,
+			RESTART_CAUSE_RESTORE_ALWAYS},
+		{"previous on", POWER_RESTORE_PREVIOUS, true, true,
+			RESTART_CAUSE_RESTORE_PREVIOUS},
+		{"previous off", POWER_RESTORE_PREVIOUS, false, false,
+			RESTART_CAUSE_UNKNOWN},
+	} {
+		mcTestReset(t)
+		driver := &simChassisDriver{}
+		mc.chassis.driver = driver
+		mc.chassis.restorePolicy = c.policy
+		mc.chassis.powerOn = c.wasOn
+
+		chassisPowerRestore()
+		if driver.on != c.on || mc.chassis.powerOn != c.on ||
+			mc.chassis.restartCause != c.cause {
+			t.Errorf("%s: on %v cause %d", c.name, driver.on,
+				mc.chassis.restartCause)
+		}
+	}
+}
@@ -7,8 +7,11 @@ package ipmigod
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"math/rand"
+	"strings"
+	"time"
 )
 
 type sensorT struct {
@@ -24,6 +27,27 @@ type sensorT struct {
 
 	value uint8
 
+	// Where real readings come from when not simulating
+	source sensorSource
+
+	// Zero means the source's or the default
+	pollInterval time.Duration
+	readTimeout  time.Duration
+	nextPoll     time.Time
+	reading      bool // a read is out, see sensorPoll
+
+	// A timed out read still running, only used by sensorRead
+	pending chan sensorReadT
+
+	// Sdr describing this sensor
+	sdr *sdrT
+
+	// Recent readings of a threshold sensor
+	history *historyT
+
+	// Conversion factors by reading for non-linear sensors
+	factors sdrFactorsTableT
+
 	hysteresisSupport  uint8
 	positiveHysteresis uint8
 	negativeHysteresis uint8
@@ -39,6 +63,376 @@ type sensorT struct {
 
 	// Current bit values
 	eventStatus uint16
+
+	// Events currently asserted, by event offset
+	eventState uint16
+
+	// Events that have occurred since the last rearm,
+	// 0 for assertion, 1 for deassertion.
+	eventLatched [2]uint16
+}
+
+// A source of real-valued sensor readings
+type sensorSource interface {
+	read() (float64, error)
+}
+
+const (
+	SENSOR_POLL_TICK    = time.Second
+	SENSOR_POLL_DEFAULT = 3 * time.Second
+	SENSOR_READ_TIMEOUT = time.Second
+)
+
+// Poll interval and read timeout of sensors by sdr id string
+type sensorPollConfigT struct {
+	interval time.Duration
+	timeout  time.Duration
+}
+
+var sensorPollConfig = map[string]sensorPollConfigT{}
+
+// Set a sensor's poll interval and read timeout from "id=interval" or
+// "id=interval/timeout", either time may be left empty for the default.
+// Takes effect for sensors created afterwards, so it is meant to be
+// called before Ipmigod, e.g. by a flag of the program.
+func SensorPollSet(s string) error {
+	var (
+		c   sensorPollConfigT
+		err error
+	)
+
+	kv := strings.SplitN(s, "=", 2)
+	if len(kv) != 2 || kv[0] == "" {
+		return errors.New("want id=interval[/timeout]")
+	}
+	times := strings.SplitN(kv[1], "/", 2)
+	if times[0] != "" {
+		c.interval, err = time.ParseDuration(times[0])
+		if err != nil {
+			return err
+		}
+	}
+	if len(times) > 1 {
+		c.timeout, err = time.ParseDuration(times[1])
+		if err != nil {
+			return err
+		}
+	}
+	sensorPollConfig[kv[0]] = c
+	return nil
+}
+
+// Returned for a read that took longer than the sensor's read timeout
+var errReadTimeout = errors.New("sensor read timed out")
+
+// Threshold indexes into sensorT.thresholds. These match the bit
+// positions of the sdr threshold masks and of the threshold comparison
+// status returned by get sensor reading.
+const (
+	THRESHOLD_LNC = iota
+	THRESHOLD_LC
+	THRESHOLD_LNR
+	THRESHOLD_UNC
+	THRESHOLD_UC
+	THRESHOLD_UNR
+	NUM_THRESHOLDS
+)
+
+const (
+	EVM_REV                = 0x04
+	EVENT_DIR_DEASSERTION  = 0x80
+	THRESHOLD_EVENT_TYPE   = 0x01
+	THRESHOLD_EVENT_DATA_1 = 0x50 // trigger reading, trigger threshold
+)
+
+// Threshold access support from the sdr sensor capabilities
+const (
+	THRESHOLD_ACCESS_NONE = iota
+	THRESHOLD_ACCESS_READABLE
+	THRESHOLD_ACCESS_SETTABLE
+	THRESHOLD_ACCESS_FIXED
+)
+
+// Hysteresis support from the sdr sensor capabilities
+const (
+	HYSTERESIS_ACCESS_NONE = iota
+	HYSTERESIS_ACCESS_READABLE
+	HYSTERESIS_ACCESS_SETTABLE
+	HYSTERESIS_ACCESS_FIXED
+)
+
+// Find the sdr of the sensor addressed by the request's lun and first
+// data byte, along with the sensor itself if it is one of ours. A nil
+// sdr means the request has already been answered with an error.
+func sensorLookup(msg *msgT) (*sensorT, *sdrT) {
+	if msg.reqDataLen() < 1 {
+		msg.returnErr(nil, IPMI_REQUEST_DATA_LENGTH_INVALID_CC)
+		return nil, nil
+	}
+	lun := msg.rmcp.message.rsLun
+	sensNum := msg.data[msg.dataStart]
+
+	entry := sdrFind(lun, sensNum)
+	if entry == nil {
+		fmt.Printf("sensorLookup: Can't find sensor %d:%d\n",
+			lun, sensNum)
+		msg.returnErr(nil, IPMI_NOT_PRESENT_CC)
+		return nil, nil
+	}
+	if sensNum == 255 {
+		return nil, entry
+	}
+	return mc.sensors[lun][sensNum], entry
+}
+
+func sdrFind(lun uint8, sensNum uint8) *sdrT {
+	entry := mc.mainSdrs.sdrs
+	for entry != nil {
+		if entry.lun == lun && entry.sensNum == sensNum &&
+			sdrIsSensor(entry) {
+			break
+		}
+		entry = entry.next
+	}
+	return entry
+}
+
+// The MM only holds proxy sdrs for LC sensors; relay commands for them
+// to the owning LC. The LC's card number is the sdr's entity instance.
+func sensorForward(msg *msgT, sdr *sdrT) {
+	card := sdr.data[9]
+	if chassisCardNum > 0 || card == 0 {
+		msg.returnErr(nil, IPMI_NOT_PRESENT_CC)
+		return
+	}
+	rsAddr := cardIpmbAddr(card)
+	conn := ipmbConn(rsAddr)
+	if conn == nil {
+		fmt.Printf("sensorForward: no route to ipmb %x\n", rsAddr)
+		msg.returnErr(nil, IPMI_DESTINATION_UNAVAILABLE_CC)
+		return
+	}
+
+	done := func(rsp []uint8) {
+		if rsp == nil {
+			fmt.Printf("sensorForward: no response from ipmb %x\n",
+				rsAddr)
+			msg.returnErr(nil, IPMI_TIMEOUT_CC)
+			return
+		}
+
+		// Completion code and data sit between the header and
+		// checksum
+		msg.returnRspData(nil, rsp[6:len(rsp)-1], uint(len(rsp)-7))
+	}
+	if !bridgeSend(conn, msg.rmcp.message.rsLun, msg.rmcp.message.netfn,
+		msg.rmcp.message.cmd,
+		msg.data[msg.dataStart:msg.dataStart+msg.reqDataLen()], done) {
+		msg.returnErr(nil, IPMI_NODE_BUSY_CC)
+	}
+}
+
+// Save a changed sdr of one of our sensors and send it to the MM,
+// which refreshes its proxy copy.
+func sdrProxyUpdate(sdr *sdrT) {
+	mc.mainSdrs.dirty = true
+	if chassisCardNum == 0 {
+		return
+	}
+	if !mmReqRsp(func() []uint8 {
+		return addSdrBuildMsg(sdr)
+	}, addSdrParseRsp) {
+		fmt.Println("ipmiClient update-sdr to MM")
+	}
+}
+
+// Event message control support from the sdr sensor capabilities
+const (
+	EVENT_SUPPORT_PER_STATE = iota
+	EVENT_SUPPORT_ENTIRE_SENSOR
+	EVENT_SUPPORT_GLOBAL
+	EVENT_SUPPORT_NONE
+)
+
+// Set sensor event enable actions on the selected events
+const (
+	EVENT_ENABLE_NO_CHANGE = iota
+	EVENT_ENABLE_SELECTED
+	EVENT_DISABLE_SELECTED
+)
+
+// Load a sensor's thresholds, hysteresis and event masks from a full
+// sensor record.
+func sensorSdrInit(sensor *sensorT, sdr *sdrT) {
+	sensor.sdr = sdr
+	caps := sdr.data[11]
+	sensor.hysteresisSupport = (caps >> 4) & 3
+	sensor.thresholdSupport = (caps >> 2) & 3
+	sensor.eventSupport = caps & 3
+	sensor.thresholdSupported = binary.LittleEndian.Uint16(sdr.data[18:20])
+
+	// sdr thresholds run UNR at byte 36 down to LNC at byte 41
+	for t := 0; t < NUM_THRESHOLDS; t++ {
+		sensor.thresholds[t] = sdr.data[41-t]
+	}
+	sensor.positiveHysteresis = sdr.data[42]
+	sensor.negativeHysteresis = sdr.data[43]
+
+	// Threshold sensors have 12 event offsets, discrete ones 15
+	var eventMask uint16 = 0x7fff
+	if sensor.eventReadingCode == THRESHOLD_EVENT_TYPE {
+		eventMask = 0x0fff
+	}
+	sensor.eventSupported[0] =
+		binary.LittleEndian.Uint16(sdr.data[14:16]) & eventMask
+	sensor.eventSupported[1] =
+		binary.LittleEndian.Uint16(sdr.data[16:18]) & eventMask
+	sensor.eventEnabled = sensor.eventSupported
+
+	if c, ok := sensorPollConfig[sdrIdString(sdr)]; ok {
+		sensor.pollInterval = c.interval
+		sensor.readTimeout = c.timeout
+	}
+}
+
+// Sensor initialization byte of sensor records
+const (
+	SDR_INIT_SCANNING   = 1 << 6
+	SDR_INIT_EVENTS     = 1 << 5
+	SDR_INIT_THRESHOLDS = 1 << 4
+	SDR_INIT_HYSTERESIS = 1 << 3
+	SDR_INIT_TYPE       = 1 << 2
+	SDR_INIT_EVENTS_ON  = 1 << 1
+	SDR_INIT_SCAN_ON    = 1 << 0
+)
+
+// Initialization agent: put back what the record's initialization
+// byte says to set up, undoing changes made by set commands.
+func sensorInitAgent(sensor *sensorT, sdr *sdrT) {
+	init := sdr.data[10]
+	full := sdrRecordType(sdr) == SDR_FULL_SENSOR
+
+	if init&SDR_INIT_TYPE != 0 {
+		sensor.sensorType = sdr.data[12]
+		sensor.eventReadingCode = sdr.data[13]
+	}
+	if init&SDR_INIT_THRESHOLDS != 0 && full {
+		for t := 0; t < NUM_THRESHOLDS; t++ {
+			sensor.thresholds[t] = sdr.data[41-t]
+		}
+	}
+	if init&SDR_INIT_HYSTERESIS != 0 && full {
+		sensor.positiveHysteresis = sdr.data[42]
+		sensor.negativeHysteresis = sdr.data[43]
+	}
+	if init&SDR_INIT_EVENTS != 0 {
+		sensor.eventEnabled = sensor.eventSupported
+		sensor.eventsEnabled = init&SDR_INIT_EVENTS_ON != 0
+		sdr.eventsEnabled = sensor.eventsEnabled
+	}
+	if init&SDR_INIT_SCANNING != 0 {
+		sensor.scanningEnabled = init&SDR_INIT_SCAN_ON != 0
+		sdr.scanningEnabled = sensor.scanningEnabled
+	}
+	sensorValuePush(sdr)
+}
+
+// Compare a threshold sensor's reading against its readable thresholds.
+// The comparison status is left in eventStatus; crossing a threshold
+// asserts its event and recovering past the hysteresis deasserts it.
+func sensorThresholdEvaluate(sensor *sensorT, sdr *sdrT) {
+	if sensor.eventReadingCode != THRESHOLD_EVENT_TYPE {
+		return
+	}
+
+	f := sdrFactors(sdr.data[:])
+	v := f.rawToInt(sensor.value)
+	readable := uint8(sensor.thresholdSupported)
+	var status uint16
+	for t := 0; t < NUM_THRESHOLDS; t++ {
+		if readable&(1<<uint(t)) == 0 {
+			continue
+		}
+		thr := f.rawToInt(sensor.thresholds[t])
+
+		var (
+			offset    uint
+			crossed   bool
+			recovered bool
+		)
+		if t <= THRESHOLD_LNR {
+			// going low
+			offset = uint(2 * t)
+			crossed = v <= thr
+			recovered = v > thr+int(sensor.positiveHysteresis)
+		} else {
+			// going high
+			offset = uint(2*t + 1)
+			crossed = v >= thr
+			recovered = v < thr-int(sensor.negativeHysteresis)
+		}
+		if crossed {
+			status |= 1 << uint(t)
+		}
+
+		evData := [3]uint8{THRESHOLD_EVENT_DATA_1 | uint8(offset),
+			sensor.value, sensor.thresholds[t]}
+		asserted := sensor.eventState&(1<<offset) != 0
+		if crossed && !asserted {
+			sensor.eventState |= 1 << offset
+			sensorEventGenerate(sensor, false, offset, evData)
+		} else if recovered && asserted {
+			sensor.eventState &^= 1 << offset
+			sensorEventGenerate(sensor, true, offset, evData)
+		}
+	}
+	sensor.eventStatus = status
+}
+
+// Log an enabled sensor event in the local SEL and, on an LC, pass it
+// on to the MM's event receiver.
+func sensorEventGenerate(sensor *sensorT, deassert bool, offset uint,
+	evData [3]uint8) {
+
+	var record [16]uint8
+
+	dir := 0
+	if deassert {
+		dir = 1
+	}
+	sensor.eventLatched[dir] |= 1 << offset
+	if !sensor.eventsEnabled ||
+		sensor.eventEnabled[dir]&(1<<offset) == 0 {
+		return
+	}
+
+	record[7] = mc.bmcIpmb
+	record[8] = sensor.lun
+	record[9] = EVM_REV
+	record[10] = sensor.sensorType
+	record[11] = sensor.num
+	record[12] = sensor.eventReadingCode
+	if deassert {
+		record[12] |= EVENT_DIR_DEASSERTION
+	}
+	copy(record[13:16], evData[:])
+	if debug {
+		fmt.Printf("sensorEventGenerate: % x\n", record[7:])
+	}
+	if err, _ := addToSel(2, record[:]); err != 0 {
+		fmt.Println("sensorEventGenerate: sel add failed", err)
+	}
+
+	// The MM's Platform Event takes the generator id ahead of the
+	// event data and the lun from the message header.
+	if chassisCardNum > 0 {
+		event := append([]uint8{record[7]}, record[9:16]...)
+		if !mmReqRsp(func() []uint8 {
+			return platformEventBuildMsg(sensor.lun, event)
+		}, platformEventParseRsp) {
+			fmt.Println("ipmiClient platform event to MM")
+		}
+	}
 }
 
 func setEventReceiver(msg *msgT) {
@@ -51,9 +445,31 @@ func getEventReceiver(msg *msgT) {
 		msg.rmcp.message.cmd)
 }
 
+// Event messages from LCs, or from the system, go into our SEL. The
+// generator id is supplied when there are 8 bytes of data, otherwise it
+// is the requester's address.
 func platformEvent(msg *msgT) {
-	fmt.Println("sensorEventNetfn not supported",
-		msg.rmcp.message.cmd)
+	var record [16]uint8
+
+	dataStart := msg.dataStart
+	record[7] = msg.rmcp.message.rqAddr
+	switch msg.reqDataLen() {
+	case 8:
+		record[7] = msg.data[dataStart]
+		dataStart++
+	case 7:
+	default:
+		msg.returnErr(nil, IPMI_REQUEST_DATA_LENGTH_INVALID_CC)
+		return
+	}
+	record[8] = msg.rmcp.message.rqLun
+	copy(record[9:16], msg.data[dataStart:dataStart+7])
+
+	if err, _ := addToSel(2, record[:]); err != 0 {
+		msg.returnErr(nil, uint8(err))
+		return
+	}
+	msg.returnErr(nil, 0)
 }
 
 func getPefCapabilities(msg *msgT) {
@@ -96,64 +512,450 @@ func petAcknowledge(msg *msgT) {
 		msg.rmcp.message.cmd)
 }
 
+// The device sdr repository holds the sdrs of our own sensors, as
+// opposed to the proxies the MM keeps for LC sensors.
+func deviceSdrLocal(entry *sdrT) bool {
+	return entry.sensNum < 255 &&
+		mc.sensors[entry.lun&3][entry.sensNum] != nil
+}
+
+// First device sdr after entry, or the first of all if entry is nil
+func deviceSdrNext(entry *sdrT) *sdrT {
+	if entry == nil {
+		entry = mc.mainSdrs.sdrs
+	} else {
+		entry = entry.next
+	}
+	for entry != nil && !deviceSdrLocal(entry) {
+		entry = entry.next
+	}
+	return entry
+}
+
+// Our sensor population changed; note when and drop any reservation
+func deviceSdrsChanged() {
+	mc.deviceSdrChangeTime = uint32(time.Now().Unix())
+	mc.deviceSdrReservation++
+	if mc.deviceSdrReservation == 0 {
+		mc.deviceSdrReservation++
+	}
+}
+
 func getDeviceSdrInfo(msg *msgT) {
-	fmt.Println("sensorEventNetfn not supported",
-		msg.rmcp.message.cmd)
+	var (
+		data    [7]uint8
+		count   uint8
+		lunMask uint8
+	)
+
+	// Sensor count for the addressed lun unless sdr count is asked for
+	sdrCount := msg.reqDataLen() >= 1 && msg.data[msg.dataStart]&1 != 0
+	entry := deviceSdrNext(nil)
+	for entry != nil {
+		lunMask |= 1 << (entry.lun & 3)
+		if sdrCount || entry.lun&3 == msg.rmcp.message.rsLun {
+			count++
+		}
+		entry = deviceSdrNext(entry)
+	}
+
+	data[0] = 0
+	data[1] = count
+	data[2] = 0x80 | lunMask // dynamic population
+	binary.LittleEndian.PutUint32(data[3:7], mc.deviceSdrChangeTime)
+
+	msg.returnRspData(nil, data[0:7], 7)
 }
 
 func getDeviceSdr(msg *msgT) {
-	fmt.Println("sensorEventNetfn not supported",
-		msg.rmcp.message.cmd)
+	var (
+		data  [MAX_MSG_RETURN_DATA]uint8
+		entry *sdrT
+	)
+
+	if msg.reqDataLen() < 6 {
+		msg.returnErr(nil, IPMI_REQUEST_DATA_LENGTH_INVALID_CC)
+		return
+	}
+	dataStart := msg.dataStart
+	reservation :=
+		binary.LittleEndian.Uint16(msg.data[dataStart : dataStart+2])
+	recordId :=
+		binary.LittleEndian.Uint16(msg.data[dataStart+2 : dataStart+4])
+	offset := uint16(msg.data[dataStart+4])
+	count := uint16(msg.data[dataStart+5])
+
+	// A reservation is only needed for partial reads, 0 is never one
+	if (offset != 0 || reservation != 0) && (reservation == 0 ||
+		reservation != mc.deviceSdrReservation) {
+		fmt.Println("getDeviceSdr: reservation mismatch", reservation,
+			mc.deviceSdrReservation)
+		msg.returnErr(nil, IPMI_INVALID_RESERVATION_CC)
+		return
+	}
+
+	entry = deviceSdrNext(nil)
+	if recordId == 0xffff {
+		for last := entry; last != nil; last = deviceSdrNext(last) {
+			entry = last
+		}
+	} else if recordId != 0 {
+		for entry != nil && entry.recordId != recordId {
+			entry = deviceSdrNext(entry)
+		}
+	}
+	if entry == nil {
+		fmt.Println("getDeviceSdr: Can't find recordId", recordId)
+		msg.returnErr(nil, IPMI_NOT_PRESENT_CC)
+		return
+	}
+
+	if offset >= entry.length {
+		fmt.Println("getDeviceSdr: offset out of range")
+		msg.returnErr(nil, IPMI_PARAMETER_OUT_OF_RANGE_CC)
+		return
+	}
+	if (offset + count) > entry.length {
+		count = entry.length - offset
+	}
+	if uint(count+3) > MAX_MSG_RETURN_DATA {
+		fmt.Println("getDeviceSdr: cannot return required data")
+		msg.returnErr(nil, IPMI_CANNOT_RETURN_REQ_LENGTH_CC)
+		return
+	}
+
+	data[0] = 0
+	if next := deviceSdrNext(entry); next != nil {
+		binary.LittleEndian.PutUint16(data[1:3], next.recordId)
+	} else {
+		data[1] = 0xff
+		data[2] = 0xff
+	}
+
+	copy(data[3:], entry.data[offset:offset+count])
+	msg.returnRspData(nil, data[0:], uint(count+3))
 }
 
 func reserveDeviceSdrRepository(msg *msgT) {
-	fmt.Println("sensorEventNetfn not supported",
-		msg.rmcp.message.cmd)
+	var data [3]uint8
+
+	mc.deviceSdrReservation++
+	if mc.deviceSdrReservation == 0 {
+		mc.deviceSdrReservation++
+	}
+
+	data[0] = 0
+	binary.LittleEndian.PutUint16(data[1:3], mc.deviceSdrReservation)
+
+	msg.returnRspData(nil, data[0:3], 3)
 }
 
 func getSensorReadingFactors(msg *msgT) {
-	fmt.Println("sensorEventNetfn not supported",
-		msg.rmcp.message.cmd)
+	var data [8]uint8
+
+	sensor, entry := sensorLookup(msg)
+	if entry == nil {
+		return
+	}
+	if sensor == nil {
+		sensorForward(msg, entry)
+		return
+	}
+	if msg.reqDataLen() < 2 {
+		msg.returnErr(nil, IPMI_REQUEST_DATA_LENGTH_INVALID_CC)
+		return
+	}
+	if sensor.eventReadingCode != THRESHOLD_EVENT_TYPE {
+		msg.returnErr(nil, IPMI_COMMAND_ILLEGAL_FOR_SENSOR_CC)
+		return
+	}
+
+	// Linear sensors just have the factors from their sdr
+	data[0] = 0
+	if !sdrNonLinear(entry) {
+		data[1] = 0xff
+		copy(data[2:8], entry.data[24:30])
+		msg.returnRspData(nil, data[0:8], 8)
+		return
+	}
+	if sensor.factors == nil {
+		fmt.Println("getSensorReadingFactors: no factors for sensor",
+			sensor.num)
+		msg.returnErr(nil, IPMI_COMMAND_ILLEGAL_FOR_SENSOR_CC)
+		return
+	}
+
+	f, next := sensor.factors.lookup(msg.data[msg.dataStart+1])
+	fb := f.bytes()
+	data[1] = next
+	copy(data[2:8], fb[:])
+
+	msg.returnRspData(nil, data[0:8], 8)
 }
 
 func setSensorHysteresis(msg *msgT) {
-	fmt.Println("sensorEventNetfn not supported",
-		msg.rmcp.message.cmd)
+	sensor, entry := sensorLookup(msg)
+	if entry == nil {
+		return
+	}
+	if sensor == nil {
+		sensorForward(msg, entry)
+		return
+	}
+	if msg.reqDataLen() < 4 {
+		msg.returnErr(nil, IPMI_REQUEST_DATA_LENGTH_INVALID_CC)
+		return
+	}
+	if sensor.eventReadingCode != THRESHOLD_EVENT_TYPE ||
+		sensor.hysteresisSupport != HYSTERESIS_ACCESS_SETTABLE {
+		msg.returnErr(nil, IPMI_COMMAND_ILLEGAL_FOR_SENSOR_CC)
+		return
+	}
+
+	// Byte 2 is the reserved hysteresis mask
+	dataStart := msg.dataStart
+	sensor.positiveHysteresis = msg.data[dataStart+2]
+	sensor.negativeHysteresis = msg.data[dataStart+3]
+	entry.data[42] = sensor.positiveHysteresis
+	entry.data[43] = sensor.negativeHysteresis
+	sensorThresholdEvaluate(sensor, entry)
+	entry.eventStatus = sensor.eventStatus
+	sdrProxyUpdate(entry)
+
+	msg.returnErr(nil, 0)
 }
 
 func getSensorHysteresis(msg *msgT) {
-	fmt.Println("sensorEventNetfn not supported",
-		msg.rmcp.message.cmd)
+	var data [3]uint8
+
+	sensor, entry := sensorLookup(msg)
+	if entry == nil {
+		return
+	}
+	if sensor == nil {
+		sensorForward(msg, entry)
+		return
+	}
+	if msg.reqDataLen() < 2 {
+		msg.returnErr(nil, IPMI_REQUEST_DATA_LENGTH_INVALID_CC)
+		return
+	}
+	if sensor.eventReadingCode != THRESHOLD_EVENT_TYPE ||
+		(sensor.hysteresisSupport != HYSTERESIS_ACCESS_READABLE &&
+			sensor.hysteresisSupport != HYSTERESIS_ACCESS_SETTABLE) {
+		msg.returnErr(nil, IPMI_COMMAND_ILLEGAL_FOR_SENSOR_CC)
+		return
+	}
+
+	data[0] = 0
+	data[1] = sensor.positiveHysteresis
+	data[2] = sensor.negativeHysteresis
+
+	msg.returnRspData(nil, data[0:3], 3)
 }
 
 func setSensorThreshold(msg *msgT) {
-	fmt.Println("sensorEventNetfn not supported",
-		msg.rmcp.message.cmd)
+	sensor, entry := sensorLookup(msg)
+	if entry == nil {
+		return
+	}
+	if sensor == nil {
+		sensorForward(msg, entry)
+		return
+	}
+	if msg.reqDataLen() < 8 {
+		msg.returnErr(nil, IPMI_REQUEST_DATA_LENGTH_INVALID_CC)
+		return
+	}
+	if sensor.eventReadingCode != THRESHOLD_EVENT_TYPE ||
+		sensor.thresholdSupport != THRESHOLD_ACCESS_SETTABLE {
+		msg.returnErr(nil, IPMI_COMMAND_ILLEGAL_FOR_SENSOR_CC)
+		return
+	}
+
+	dataStart := msg.dataStart
+	mask := msg.data[dataStart+1]
+	settable := uint8(sensor.thresholdSupported >> 8)
+	if mask&^settable != 0 {
+		msg.returnErr(nil, IPMI_INVALID_DATA_FIELD_CC)
+		return
+	}
+
+	for t := 0; t < NUM_THRESHOLDS; t++ {
+		if mask&(1<<uint(t)) == 0 {
+			continue
+		}
+		sensor.thresholds[t] = msg.data[dataStart+2+uint(t)]
+		entry.data[41-t] = sensor.thresholds[t]
+	}
+	sensorThresholdEvaluate(sensor, entry)
+	entry.eventStatus = sensor.eventStatus
+	sdrProxyUpdate(entry)
+
+	msg.returnErr(nil, 0)
 }
 
 func getSensorThreshold(msg *msgT) {
-	fmt.Println("sensorEventNetfn not supported",
-		msg.rmcp.message.cmd)
+	var data [8]uint8
+
+	sensor, entry := sensorLookup(msg)
+	if entry == nil {
+		return
+	}
+	if sensor == nil {
+		sensorForward(msg, entry)
+		return
+	}
+	if sensor.eventReadingCode != THRESHOLD_EVENT_TYPE {
+		msg.returnErr(nil, IPMI_COMMAND_ILLEGAL_FOR_SENSOR_CC)
+		return
+	}
+
+	// Thresholds are only readable when the sensor says so
+	data[0] = 0
+	if sensor.thresholdSupport == THRESHOLD_ACCESS_READABLE ||
+		sensor.thresholdSupport == THRESHOLD_ACCESS_SETTABLE {
+		data[1] = uint8(sensor.thresholdSupported) & 0x3f
+	}
+	for t := 0; t < NUM_THRESHOLDS; t++ {
+		if data[1]&(1<<uint(t)) != 0 {
+			data[2+t] = sensor.thresholds[t]
+		}
+	}
+
+	msg.returnRspData(nil, data[0:8], 8)
 }
 
 func setSensorEventEnable(msg *msgT) {
-	fmt.Println("sensorEventNetfn not supported",
-		msg.rmcp.message.cmd)
+	var masks [2]uint16
+
+	sensor, entry := sensorLookup(msg)
+	if entry == nil {
+		return
+	}
+	if sensor == nil {
+		sensorForward(msg, entry)
+		return
+	}
+	if msg.reqDataLen() < 2 {
+		msg.returnErr(nil, IPMI_REQUEST_DATA_LENGTH_INVALID_CC)
+		return
+	}
+
+	// Assertion and deassertion masks are optional, missing bytes
+	// select nothing
+	dataStart := msg.dataStart
+	reqLen := msg.reqDataLen()
+	for i := uint(2); i < 6 && i < reqLen; i++ {
+		masks[(i-2)/2] |= uint16(msg.data[dataStart+i]) << (8 * (i & 1))
+	}
+
+	action := (msg.data[dataStart+1] >> 4) & 3
+	if action != EVENT_ENABLE_NO_CHANGE &&
+		sensor.eventSupport != EVENT_SUPPORT_PER_STATE {
+		msg.returnErr(nil, IPMI_INVALID_DATA_FIELD_CC)
+		return
+	}
+	for dir := 0; dir < 2; dir++ {
+		switch action {
+		case EVENT_ENABLE_SELECTED:
+			sensor.eventEnabled[dir] |= masks[dir]
+		case EVENT_DISABLE_SELECTED:
+			sensor.eventEnabled[dir] &^= masks[dir]
+		case EVENT_ENABLE_NO_CHANGE:
+		default:
+			msg.returnErr(nil, IPMI_INVALID_DATA_FIELD_CC)
+			return
+		}
+		sensor.eventEnabled[dir] &= sensor.eventSupported[dir]
+	}
+
+	sensor.eventsEnabled = msg.data[dataStart+1]&0x80 != 0
+	sensor.scanningEnabled = msg.data[dataStart+1]&0x40 != 0
+	entry.eventsEnabled = sensor.eventsEnabled
+	entry.scanningEnabled = sensor.scanningEnabled
+	sensorValuePush(entry)
+
+	msg.returnErr(nil, 0)
 }
 
 func getSensorEventEnable(msg *msgT) {
-	fmt.Println("sensorEventNetfn not supported",
-		msg.rmcp.message.cmd)
+	var data [6]uint8
+
+	sensor, entry := sensorLookup(msg)
+	if entry == nil {
+		return
+	}
+	if sensor == nil {
+		sensorForward(msg, entry)
+		return
+	}
+
+	data[0] = 0
+	data[1] = sdrReadingFlags(entry) & 0xc0
+	binary.LittleEndian.PutUint16(data[2:4], sensor.eventEnabled[0])
+	binary.LittleEndian.PutUint16(data[4:6], sensor.eventEnabled[1])
+
+	msg.returnRspData(nil, data[0:6], 6)
 }
 
+// Clear latched event status, all of it or just the selected bits. Any
+// condition still present is asserted again right away.
 func rearmSensorEvents(msg *msgT) {
-	fmt.Println("sensorEventNetfn not supported",
-		msg.rmcp.message.cmd)
+	var masks [2]uint16
+
+	sensor, entry := sensorLookup(msg)
+	if entry == nil {
+		return
+	}
+	if sensor == nil {
+		sensorForward(msg, entry)
+		return
+	}
+	if msg.reqDataLen() < 2 {
+		msg.returnErr(nil, IPMI_REQUEST_DATA_LENGTH_INVALID_CC)
+		return
+	}
+
+	dataStart := msg.dataStart
+	reqLen := msg.reqDataLen()
+	if msg.data[dataStart+1]&0x80 == 0 {
+		masks = [2]uint16{0xffff, 0xffff}
+	} else {
+		for i := uint(2); i < 6 && i < reqLen; i++ {
+			masks[(i-2)/2] |=
+				uint16(msg.data[dataStart+i]) << (8 * (i & 1))
+		}
+	}
+
+	sensor.eventLatched[0] &^= masks[0]
+	sensor.eventLatched[1] &^= masks[1]
+	sensor.eventState &^= masks[0] | masks[1]
+	sensorThresholdEvaluate(sensor, entry)
+	sensorDiscreteEvaluate(sensor)
+	entry.eventStatus = sensor.eventStatus
+
+	msg.returnErr(nil, 0)
 }
 
 func getSensorEventStatus(msg *msgT) {
-	fmt.Println("sensorEventNetfn not supported",
-		msg.rmcp.message.cmd)
+	var data [6]uint8
+
+	sensor, entry := sensorLookup(msg)
+	if entry == nil {
+		return
+	}
+	if sensor == nil {
+		sensorForward(msg, entry)
+		return
+	}
+
+	data[0] = 0
+	data[1] = sdrReadingFlags(entry)
+	binary.LittleEndian.PutUint16(data[2:4], sensor.eventLatched[0])
+	binary.LittleEndian.PutUint16(data[4:6], sensor.eventLatched[1])
+
+	msg.returnRspData(nil, data[0:6], 6)
 }
 
 func getSensorReading(msg *msgT) {
@@ -181,100 +983,349 @@ func getSensorReading(msg *msgT) {
 
 	data[0] = 0
 	data[1] = entry.value
-	var sensEn uint8
+	data[2] = sdrReadingFlags(entry)
+	binary.LittleEndian.PutUint16(data[3:5], entry.eventStatus)
+
+	msg.returnRspData(nil, data[0:5], 5)
+}
+
+// Marks a special addSdr carrying a sensor update, in the otherwise
+// unused low bits of the reading flags.
+const SDR_VALUE_UPDATE = 0x01
+
+// Byte 2 of get sensor reading and get sensor event status, the global
+// event message and scanning enables and reading unavailable.
+func sdrReadingFlags(entry *sdrT) uint8 {
+	var flags uint8
+
 	if entry.eventsEnabled {
-		sensEn = 1
-	} else {
-		sensEn = 0
+		flags |= 0x80
 	}
-	var scanEn uint8
 	if entry.scanningEnabled && entry.enabled {
-		scanEn = 1
-	} else {
-		scanEn = 0
+		flags |= 0x40
 	}
-	data[2] = (sensEn << 7) | (scanEn << 6)
-	binary.LittleEndian.PutUint16(data[3:5], entry.eventStatus)
+	if entry.readingUnavailable {
+		flags |= 0x20
+	}
+	return flags
+}
 
-	msg.returnRspData(nil, data[0:5], 5)
+// Like sensorLookup but also finds our sensors that have no sdr, such
+// as OEM sensors. Either may be nil when ok.
+func sensorLookupAny(msg *msgT) (sensor *sensorT, entry *sdrT, ok bool) {
+	if msg.reqDataLen() < 1 {
+		msg.returnErr(nil, IPMI_REQUEST_DATA_LENGTH_INVALID_CC)
+		return nil, nil, false
+	}
+	lun := msg.rmcp.message.rsLun
+	sensNum := msg.data[msg.dataStart]
+
+	if sensNum < 255 {
+		sensor = mc.sensors[lun][sensNum]
+	}
+	entry = sdrFind(lun, sensNum)
+	if sensor == nil && entry == nil {
+		fmt.Printf("sensorLookupAny: Can't find sensor %d:%d\n",
+			lun, sensNum)
+		msg.returnErr(nil, IPMI_NOT_PRESENT_CC)
+		return nil, nil, false
+	}
+	return sensor, entry, true
 }
 
 func setSensorType(msg *msgT) {
-	fmt.Println("sensorEventNetfn not supported",
-		msg.rmcp.message.cmd)
+	sensor, entry, ok := sensorLookupAny(msg)
+	if !ok {
+		return
+	}
+	if sensor == nil {
+		sensorForward(msg, entry)
+		return
+	}
+	if msg.reqDataLen() < 3 {
+		msg.returnErr(nil, IPMI_REQUEST_DATA_LENGTH_INVALID_CC)
+		return
+	}
+
+	// Events asserted under the old type no longer mean anything
+	dataStart := msg.dataStart
+	sensor.sensorType = msg.data[dataStart+1]
+	sensor.eventReadingCode = msg.data[dataStart+2] & 0x7f
+	sensor.eventState = 0
+	sensor.eventStatus = 0
+	if entry != nil {
+		entry.data[12] = sensor.sensorType
+		entry.data[13] = sensor.eventReadingCode
+		entry.eventStatus = 0
+		sdrProxyUpdate(entry)
+	}
+
+	msg.returnErr(nil, 0)
 }
 
 func getSensorType(msg *msgT) {
-	fmt.Println("sensorEventNetfn not supported",
-		msg.rmcp.message.cmd)
+	var data [3]uint8
+
+	sensor, entry, ok := sensorLookupAny(msg)
+	if !ok {
+		return
+	}
+	if sensor == nil {
+		sensorForward(msg, entry)
+		return
+	}
+
+	data[0] = 0
+	data[1] = sensor.sensorType
+	data[2] = sensor.eventReadingCode & 0x7f
+
+	msg.returnRspData(nil, data[0:3], 3)
 }
 
+// Poll each sensor that is due, at its own interval. This runs on the
+// main loop, which owns the sensors and the SEL. Hardware is read by a
+// goroutine per read and the reading comes back to the main loop on
+// sensorReadings, so a slow or stuck backend holds up only its sensor.
 func pollSensors() {
+	now := time.Now()
+	for _, sensor := range mc.sensorList {
+		if !sensor.scanningEnabled || sensor.sdr == nil ||
+			sensor.reading || now.Before(sensor.nextPoll) {
+			continue
+		}
+		sensor.nextPoll = now.Add(sensorPollInterval(sensor))
+		sensorPoll(sensor, sensor.sdr)
+	}
+}
 
-	var (
-		value   uint8
-		lun     uint8
-		sensNum uint8
-		entry   *sdrT
-		msgData []uint8
-		try     int
-	)
+func sensorPoll(sensor *sensorT, entry *sdrT) {
+	if sensor.source == nil {
+		sensorReadingUpdate(sensor, entry, 0, errNoReading)
+		return
+	}
+	if _, ok := sensor.source.(sensorLocalSource); ok {
+		reading, err := sensor.source.read()
+		sensorReadingUpdate(sensor, entry, reading, err)
+		return
+	}
+
+	sensor.reading = true
+	source := sensor.source
+	timeout := sensor.readTimeout
+	if timeout == 0 {
+		timeout = SENSOR_READ_TIMEOUT
+	}
+	go func() {
+		reading, err := sensorRead(sensor, source, timeout)
+		sensorReadings <- sensorReadT{sensor, reading, err}
+	}()
+}
+
+// A read started by sensorPoll is done, called from the main loop
+func sensorReadDone(r sensorReadT) {
+	r.sensor.reading = false
+	if r.sensor.sdr != nil {
+		sensorReadingUpdate(r.sensor, r.sensor.sdr, r.value, r.err)
+	}
+}
+
+// Update a sensor from a reading of its source and generate the events
+// it causes
+func sensorReadingUpdate(sensor *sensorT, entry *sdrT, reading float64,
+	err error) {
+
+	var value uint8
 
-	for lun = 0; lun < 4; lun++ {
-		for sensNum = 1; sensNum < 255; sensNum++ {
-			if mc.sensors[lun][sensNum] == nil {
-				continue
-			}
-			sensor := mc.sensors[lun][sensNum]
-
-			if simulate {
-				// update sensors locally only
-				switch sensNum {
-				case 1, 17, 33:
-					value = uint8(rand.Int()&0xf) + 20
-				case 2, 18, 34:
-					value = uint8(rand.Int() & 0xf)
-				case 3, 19, 35:
-					value = uint8(rand.Int() & 0x7)
-				case 4, 20, 36:
-					value = uint8(rand.Int() & 0x3f)
-				}
-			} else {
-				// FIXME - need to go out to sysfs for value
-				// for local sensors. If sensNum >=16 then
-				// we are on LC and need to initiate
-				// partialAddSdr to MM
-			}
-			sensor.value = value
-
-			// Find and update SDR for this sensor
-			entry = mc.mainSdrs.sdrs
-			for entry != nil {
-				if entry.lun == lun &&
-					entry.sensNum == sensNum {
-					break
-				}
-				entry = entry.next
-			}
-			entry.value = value
-
-			// If we are on LC and need to initiate
-			// special addSdr to MM. This special addSdr will use
-			// oem field of SDR record to sneak out the
-			// sensor reading for this sensor.
-			if chassisCardNum > 0 {
-				msgData = addSdrBuildMsg(entry)
-				msgData[66] = value
-				for try = 0; try < MAX_RETRIES; try++ {
-					if ipmiReqRsp(mc.mmConn, msgData,
-						addSdrParseRsp) {
-						break
-					}
-				}
-				if try >= MAX_RETRIES {
-					fmt.Println("ipmiClient spec add-sdr to MM")
-				}
-			}
+	// Discrete sensors read their state bitmap
+	if sensor.eventReadingCode != THRESHOLD_EVENT_TYPE {
+		if err == errNoReading {
+			return
 		}
+		if sensorAvailable(sensor, entry, err) {
+			sensor.eventStatus = discreteState(reading)
+			sensorDiscreteEvaluate(sensor)
+			entry.eventStatus = sensor.eventStatus
+		}
+		sensorValuePush(entry)
+		return
+	}
+
+	// Convert the reading per the sensor's SDR
+	if err == nil {
+		value = sensorRawFromReal(sensor, entry, reading)
+	}
+	if err != nil && err != errNoReading {
+		sensorAvailable(sensor, entry, err)
+		sensorValuePush(entry)
+		return
+	}
+	if err != nil {
+		if !simulate {
+			return
+		}
+		// update sensors locally only
+		switch sensor.num {
+		case 1, 17, 33:
+			value = uint8(rand.Int()&0xf) + 20
+		case 2, 18, 34:
+			value = uint8(rand.Int() & 0xf)
+		case 3, 19, 35:
+			value = uint8(rand.Int() & 0x7)
+		case 4, 20, 36:
+			value = uint8(rand.Int() & 0x3f)
+		}
+	}
+	sensorAvailable(sensor, entry, nil)
+	sensor.value = value
+	entry.value = value
+	historyAdd(sensor, entry)
+	sensorThresholdEvaluate(sensor, entry)
+	entry.eventStatus = sensor.eventStatus
+
+	sensorValuePush(entry)
+}
+
+// Convert a raw reading into a real value, non-linear sensors use
+// their per reading factors.
+func sensorRealFromRaw(sensor *sensorT, sdr *sdrT, raw uint8) float64 {
+	if sdrNonLinear(sdr) {
+		if sensor.factors == nil {
+			return 0
+		}
+		f, _ := sensor.factors.lookup(raw)
+		f.format = sdr.data[20] >> 6
+		f.linear = SDR_LINEAR
+		return f.toReal(raw)
+	}
+	return sdrRealFromRaw(sdr, raw)
+}
+
+// Note whether the last read worked. A sensor whose read failed shows
+// its reading as unavailable rather than reporting stale data.
+func sensorAvailable(sensor *sensorT, entry *sdrT, err error) bool {
+	if err != nil && !entry.readingUnavailable {
+		fmt.Println("sensorPoll:", sensor.lun, sensor.num, err)
+	}
+	entry.readingUnavailable = err != nil
+	return err == nil
+}
+
+// Backends may ask for their own poll interval, e.g. slow PMBus
+// devices behind I2C.
+type sensorPollPeriod interface {
+	pollPeriod() time.Duration
+}
+
+func sensorPollInterval(sensor *sensorT) time.Duration {
+	if sensor.pollInterval != 0 {
+		return sensor.pollInterval
+	}
+	if p, ok := sensor.source.(sensorPollPeriod); ok {
+		return p.pollPeriod()
+	}
+	return SENSOR_POLL_DEFAULT
+}
+
+// Sources computed from ipmigod's own state, rather than read from
+// hardware, are read right on the main loop along with that state.
+type sensorLocalSource interface {
+	localSource()
+}
+
+type sensorReadT struct {
+	sensor *sensorT
+	value  float64
+	err    error
+}
+
+// Readings of sensor sources, for the main loop
+var sensorReadings = make(chan sensorReadT, 16)
+
+// Read a sensor's source, giving up after timeout. A read that timed
+// out is left to finish on its own and the sensor isn't read again
+// until it has. Runs in the goroutine sensorPoll starts, only one at a
+// time per sensor.
+func sensorRead(sensor *sensorT, source sensorSource,
+	timeout time.Duration) (float64, error) {
+
+	if sensor.pending != nil {
+		select {
+		case <-sensor.pending:
+			sensor.pending = nil
+		default:
+			return 0, errReadTimeout
+		}
+	}
+
+	done := make(chan sensorReadT, 1)
+	go func() {
+		v, err := source.read()
+		done <- sensorReadT{value: v, err: err}
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case r := <-done:
+		return r.value, r.err
+	case <-timer.C:
+		sensor.pending = done
+		return 0, errReadTimeout
 	}
 }
+
+// Convert a real reading into the raw byte, non-linear sensors use
+// their per reading factors.
+func sensorRawFromReal(sensor *sensorT, sdr *sdrT, value float64) uint8 {
+	if sdrNonLinear(sdr) {
+		if sensor.factors == nil {
+			return 0
+		}
+		return sensor.factors.toRaw(sdr, value)
+	}
+	return sdrRawFromReal(sdr, value)
+}
+
+// If we are on LC we need to initiate special addSdr to MM. This
+// special addSdr will use oem field of SDR record to sneak out the
+// sensor reading for this sensor, and the bytes ahead of it for the
+// event status and the event/scanning enables. The MM takes nothing
+// else from an update so the high status byte can use the hysteresis
+// byte. Discrete sensors may read 0, so the enables byte also marks the
+// update as special. An update is only sent when it changed, or every
+// SENSOR_PUSH_REFRESH which keeps the card present on the MM.
+func sensorValuePush(entry *sdrT) {
+	if chassisCardNum == 0 {
+		return
+	}
+	update := sensorValueBytes(entry)
+	if update == entry.pushed &&
+		time.Since(entry.pushTime) < SENSOR_PUSH_REFRESH {
+		return
+	}
+	build := func() []uint8 {
+		return sensorValueBuildMsg(entry, update)
+	}
+	if !mmReqRsp(build, addSdrParseRsp) {
+		fmt.Println("ipmiClient spec add-sdr to MM")
+		return
+	}
+	entry.pushed = update
+	entry.pushTime = time.Now()
+}
+
+const SENSOR_PUSH_REFRESH = CARD_PRESENCE_TIMEOUT / 2
+
+// The record bytes 43-46 of a value update
+func sensorValueBytes(entry *sdrT) [4]uint8 {
+	return [4]uint8{uint8(entry.eventStatus >> 8), uint8(entry.eventStatus),
+		sdrReadingFlags(entry) | SDR_VALUE_UPDATE, entry.value}
+}
+
+// The update goes in a copy of the record so the message checksum
+// covers it
+func sensorValueBuildMsg(entry *sdrT, update [4]uint8) []uint8 {
+	record := *entry
+	copy(record.data[43:47], update[:])
+	return addSdrBuildMsg(&record)
+}
@@ -0,0 +1,761 @@
+// Copyright 2015 Platina Systems, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style license described in the
+// LICENSE file.
+
+// Package contains IPMI 2.0 spec implementation
+package ipmigod
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+// Parse a lan request as the server would and pass it to handler.
+// Returns the response data, completion code first.
+func testMsgRun(t *testing.T, wire []uint8, handler func(*msgT)) []uint8 {
+	msg, client := testMsgStart(t, wire)
+	handler(msg)
+	return testMsgRsp(t, client)
+}
+
+// Parse a lan request as the server would, its response goes to the
+// returned client
+func testMsgStart(t *testing.T, wire []uint8) (*msgT, *net.UDPConn) {
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	client, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	msg := new(msgT)
+	msg.conn = conn
+	msg.remoteAddr = client.LocalAddr().(*net.UDPAddr)
+	msg.dataLen = uint(copy(msg.data[:], wire))
+	msg.ipmiParseMsg()
+	return msg, client
+}
+
+// Read the response data sent to client, completion code first
+func testMsgRsp(t *testing.T, client *net.UDPConn) []uint8 {
+	rsp := make([]uint8, MAX_MSG_RETURN_DATA)
+	client.SetReadDeadline(time.Now().Add(BRIDGE_TIMEOUT))
+	n, _, err := client.ReadFromUDP(rsp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rsp[20 : n-1]
+}
+
+// Build a request without a session
+func testMsgBuild(netFn uint8, cmd uint8, req []uint8) []uint8 {
+	return clientBuildMsg(req, uint8(len(req)), uint8(len(req)+7), 0, 0,
+		0, netFn, 0, 1, cmd)
+}
+
+// Save the repository as the main loop would, then load it back into
+// an empty one as a restart would
+func testSdrsReload(t *testing.T) {
+	if !mc.mainSdrs.dirty {
+		t.Error("change not marked for saving")
+	}
+	sdrsSaveRun()
+	mc.mainSdrs = sdrsT{maxSdrCount: MAX_NUM_SDRS, nextFreeEntryId: 1}
+	sdrsLoad()
+}
+
+// Stand in for the MM, answering each request on the LC's connection
+// to it with rsp and passing on the requests received
+func testMmStart(t *testing.T, netFn uint8, cmd uint8,
+	rsp []uint8) <-chan []uint8 {
+
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	mm, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mc.mmConn, err = net.Dial("udp", mm.LocalAddr().String())
+	if err != nil {
+		mm.Close()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { mm.Close(); mc.mmConn.Close(); mc.mmConn = nil })
+
+	received := make(chan []uint8, 16)
+	go func() {
+		for {
+			req := make([]uint8, MAX_MSG_RETURN_DATA)
+			n, addr, err := mm.ReadFromUDP(req)
+			if err != nil {
+				return
+			}
+			received <- req[:n]
+			mm.WriteToUDP(clientBuildMsg(rsp, uint8(len(rsp)),
+				uint8(len(rsp)+7), 0, 0, 0, netFn|1, 0,
+				req[18]>>2, cmd), addr)
+		}
+	}()
+	return received
+}
+
+// An event generated on an LC is forwarded as a Platform Event and
+// must log the same SEL record on the MM.
+func TestPlatformEventForward(t *testing.T) {
+	mcTestReset(t)
+	chassisCardNum = 1
+	mc.bmcIpmb = cardIpmbAddr(1)
+	defer func() { chassisCardNum = 0 }()
+
+	received := testMmStart(t, SENSOR_EVENT_NETFN, PLATFORM_EVENT_CMD,
+		[]uint8{0})
+
+	sensorAdd(mc.bmcIpmb, 1, 18, 0x01, 1)
+	sensor := mc.sensors[1][18]
+	sensor.eventEnabled[0] = 1 << 7
+	sensorEventGenerate(sensor, false, 7, [3]uint8{0x57, 0x40, 0x41})
+	if mc.sel.count != 1 {
+		t.Fatalf("event not logged, sel count %d", mc.sel.count)
+	}
+	lcRecord := mc.sel.entries[0].data
+	lcEvent := <-received
+
+	// Now on the MM
+	mcTestReset(t)
+	rsp := testMsgRun(t, lcEvent, platformEvent)
+	if rsp[0] != 0 {
+		t.Fatalf("platform event completion code %#x", rsp[0])
+	}
+	if mc.sel.count != 1 {
+		t.Fatalf("sel count %d on the MM", mc.sel.count)
+	}
+	mmRecord := mc.sel.entries[0].data
+	if !bytes.Equal(mmRecord[7:], lcRecord[7:]) {
+		t.Errorf("MM logged % x, LC logged % x", mmRecord[7:],
+			lcRecord[7:])
+	}
+}
+
+func TestPlatformEventLength(t *testing.T) {
+	mcTestReset(t)
+	for _, n := range []int{6, 9} {
+		wire := testMsgBuild(SENSOR_EVENT_NETFN, PLATFORM_EVENT_CMD,
+			make([]uint8, n))
+		rsp := testMsgRun(t, wire, platformEvent)
+		if rsp[0] != IPMI_REQUEST_DATA_LENGTH_INVALID_CC {
+			t.Errorf("%d bytes: completion code %#x", n, rsp[0])
+		}
+	}
+	if mc.sel.count != 0 {
+		t.Errorf("sel count %d", mc.sel.count)
+	}
+}
+
+func TestSensorPollSet(t *testing.T) {
+	defer func() { sensorPollConfig = map[string]sensorPollConfigT{} }()
+
+	for _, bad := range []string{"", "0board", "=1s", "0board=1x",
+		"0board=1s/x"} {
+		if SensorPollSet(bad) == nil {
+			t.Errorf("%q accepted", bad)
+		}
+	}
+	if err := SensorPollSet("0board=10s/3s"); err != nil {
+		t.Fatal(err)
+	}
+	if err := SensorPollSet("0lm75-in1=/2s"); err != nil {
+		t.Fatal(err)
+	}
+
+	mcTestReset(t)
+	root := t.TempDir()
+	testTreeWrite(t, root, testHwmonTree)
+	hwmonSensorsAdd(root)
+
+	for i, want := range []sensorPollConfigT{
+		{0, 2 * time.Second},
+		{10 * time.Second, 3 * time.Second},
+		{0, 0},
+	} {
+		sensor := mc.sensors[0][i+1]
+		if sensor.pollInterval != want.interval ||
+			sensor.readTimeout != want.timeout {
+			t.Errorf("sensor %d: interval %v timeout %v", i+1,
+				sensor.pollInterval, sensor.readTimeout)
+		}
+	}
+	if sensorPollInterval(mc.sensors[0][3]) != HWMON_SLOW_POLL {
+		t.Errorf("pmbus sensor polled every %v",
+			sensorPollInterval(mc.sensors[0][3]))
+	}
+}
+
+// A reading past a threshold comes back to the main loop, which logs
+// the event
+func TestSensorPollEvent(t *testing.T) {
+	mcTestReset(t)
+	root := t.TempDir()
+	testTreeWrite(t, root, testHwmonTree)
+	hwmonSensorsAdd(root)
+	testTreeWrite(t, root, map[string]string{"hwmon0/temp1_input": "90000"})
+
+	pollSensors()
+	for range mc.sensorList {
+		sensorReadDone(<-sensorReadings)
+	}
+	if mc.sel.count != 1 {
+		t.Fatalf("sel count %d", mc.sel.count)
+	}
+	// Upper non-critical going high
+	record := mc.sel.entries[0].data
+	if record[11] != 2 || record[12] != THRESHOLD_EVENT_TYPE ||
+		record[13] != THRESHOLD_EVENT_DATA_1|7 {
+		t.Errorf("event % x", record[7:])
+	}
+}
+
+type testStuckSource struct {
+	release chan struct{}
+}
+
+func (s *testStuckSource) read() (float64, error) {
+	<-s.release
+	return 42, nil
+}
+
+// A stuck read times out and the sensor isn't read again until the
+// read finishes
+func TestSensorReadTimeout(t *testing.T) {
+	mcTestReset(t)
+	root := t.TempDir()
+	testTreeWrite(t, root, testHwmonTree)
+	hwmonSensorsAdd(root)
+	sensor := mc.sensors[0][2]
+	source := &testStuckSource{release: make(chan struct{})}
+	sensor.source = source
+	sensor.readTimeout = 10 * time.Millisecond
+
+	for i, want := range []bool{true, true, false} {
+		if i == 2 {
+			close(source.release)
+			for len(sensor.pending) == 0 {
+				time.Sleep(time.Millisecond)
+			}
+		}
+		sensorPoll(sensor, sensor.sdr)
+		if !sensor.reading {
+			t.Fatalf("poll %d: no read started", i)
+		}
+		sensorReadDone(<-sensorReadings)
+		if sensor.sdr.readingUnavailable != want {
+			t.Errorf("poll %d: reading unavailable %v", i, !want)
+		}
+	}
+	if sensor.value == 0 {
+		t.Error("reading not taken after the read finished")
+	}
+}
+
+// An LC only sends a sensor's value to the MM when it changed, or to
+// refresh it
+func TestSensorValuePush(t *testing.T) {
+	mcTestReset(t)
+	chassisCardNum = 1
+	mc.bmcIpmb = cardIpmbAddr(1)
+	defer func() { chassisCardNum = 0 }()
+	received := testMmStart(t, STORAGE_NETFN, ADD_SDR_CMD,
+		[]uint8{0, 1, 0})
+
+	entry := mainSdrAdd(&FullSensorSdr{SdrSensor: SdrSensor{
+		OwnerId: mc.bmcIpmb, Number: 18}, SensorType: 1,
+		EventReadingType: THRESHOLD_EVENT_TYPE, SdrId: sdrId("1temp")})
+	<-received // the record itself
+	for _, c := range []struct {
+		name  string
+		value uint8
+		stale bool
+		sent  bool
+	}{
+		{"first", 40, false, true},
+		{"unchanged", 40, false, false},
+		{"changed", 41, false, true},
+		{"refresh", 41, true, true},
+	} {
+		entry.value = c.value
+		if c.stale {
+			entry.pushTime = time.Now().Add(-SENSOR_PUSH_REFRESH)
+		}
+		sensorValuePush(entry)
+		sent := false
+		select {
+		case req := <-received:
+			sent = true
+			if req[66] != c.value {
+				t.Errorf("%s: sent value %d", c.name, req[66])
+			}
+		default:
+		}
+		if sent != c.sent {
+			t.Errorf("%s: sent %v", c.name, sent)
+		}
+	}
+}
+
+// A value update is a valid message, checksums included
+func TestSensorValueBuildMsg(t *testing.T) {
+	mcTestReset(t)
+	entry := mainSdrAdd(&FullSensorSdr{SdrSensor: SdrSensor{
+		OwnerId: mc.bmcIpmb, Number: 18}, SensorType: 1,
+		EventReadingType: THRESHOLD_EVENT_TYPE, SdrId: sdrId("1temp")})
+	entry.value = 40
+	entry.eventStatus = 1<<THRESHOLD_UNC | 1<<8
+	record := entry.data
+
+	update := sensorValueBytes(entry)
+	msg := sensorValueBuildMsg(entry, update)
+	if ipmiChecksum(msg[14:17], 3, 0) != 0 ||
+		ipmiChecksum(msg[17:], len(msg)-17, 0) != 0 {
+		t.Errorf("bad checksum: % x", msg)
+	}
+	if !bytes.Equal(msg[63:67], update[:]) {
+		t.Errorf("update % x, want % x", msg[63:67], update)
+	}
+	if entry.data != record {
+		t.Error("record changed")
+	}
+}
+
+// Hysteresis is set and read per the sensor's support level and the
+// new values are saved with its sdr
+func TestSensorHysteresis(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		support uint8
+		set     []uint8
+		setCc   uint8
+		get     []uint8
+		getCc   uint8
+		hyst    [2]uint8
+	}{
+		{"no sensor number", HYSTERESIS_ACCESS_SETTABLE, nil,
+			IPMI_REQUEST_DATA_LENGTH_INVALID_CC, nil,
+			IPMI_REQUEST_DATA_LENGTH_INVALID_CC, [2]uint8{}},
+		{"short", HYSTERESIS_ACCESS_SETTABLE, []uint8{1, 0xff, 3},
+			IPMI_REQUEST_DATA_LENGTH_INVALID_CC, []uint8{1},
+			IPMI_REQUEST_DATA_LENGTH_INVALID_CC, [2]uint8{}},
+		{"unknown sensor", HYSTERESIS_ACCESS_SETTABLE,
+			[]uint8{9, 0xff, 3, 4}, IPMI_NOT_PRESENT_CC,
+			[]uint8{9, 0xff}, IPMI_NOT_PRESENT_CC, [2]uint8{}},
+		{"settable", HYSTERESIS_ACCESS_SETTABLE,
+			[]uint8{1, 0xff, 3, 4}, 0, []uint8{1, 0xff}, 0,
+			[2]uint8{3, 4}},
+		{"readable", HYSTERESIS_ACCESS_READABLE,
+			[]uint8{1, 0xff, 3, 4}, IPMI_COMMAND_ILLEGAL_FOR_SENSOR_CC,
+			[]uint8{1, 0xff}, 0, [2]uint8{}},
+		{"none", HYSTERESIS_ACCESS_NONE, []uint8{1, 0xff, 3, 4},
+			IPMI_COMMAND_ILLEGAL_FOR_SENSOR_CC, []uint8{1, 0xff},
+			IPMI_COMMAND_ILLEGAL_FOR_SENSOR_CC, [2]uint8{}},
+	} {
+		mcTestReset(t)
+		root := t.TempDir()
+		testTreeWrite(t, root, testHwmonTree)
+		hwmonSensorsAdd(root)
+		sensor := mc.sensors[0][1]
+		sensor.hysteresisSupport = c.support
+		sensor.positiveHysteresis = 0
+		sensor.negativeHysteresis = 0
+		mc.mainSdrs.dirty = false
+
+		rsp := testMsgRun(t, testMsgBuild(SENSOR_EVENT_NETFN,
+			SET_SENSOR_HYSTERESIS_CMD, c.set), setSensorHysteresis)
+		if rsp[0] != c.setCc {
+			t.Errorf("%s: set completion code %#x", c.name, rsp[0])
+		}
+		rsp = testMsgRun(t, testMsgBuild(SENSOR_EVENT_NETFN,
+			GET_SENSOR_HYSTERESIS_CMD, c.get), getSensorHysteresis)
+		if rsp[0] != c.getCc {
+			t.Errorf("%s: get completion code %#x", c.name, rsp[0])
+		} else if c.getCc == 0 && (len(rsp) != 3 ||
+			[2]uint8{rsp[1], rsp[2]} != c.hyst) {
+			t.Errorf("%s: get response % x", c.name, rsp)
+		}
+		if c.setCc != 0 {
+			continue
+		}
+
+		testSdrsReload(t)
+		entry := sdrFind(0, 1)
+		if entry == nil || [2]uint8{entry.data[42],
+			entry.data[43]} != c.hyst {
+			t.Errorf("%s: hysteresis not saved", c.name)
+		}
+	}
+}
+
+// Add the test hwmon sensors, the first one supporting and
+// enabling a couple of events each way
+func testEventSensorAdd(t *testing.T) *sensorT {
+	mcTestReset(t)
+	root := t.TempDir()
+	testTreeWrite(t, root, testHwmonTree)
+	hwmonSensorsAdd(root)
+	sensor := mc.sensors[0][1]
+	sensor.eventSupported = [2]uint16{0x0003, 0x0300}
+	sensor.eventEnabled = sensor.eventSupported
+	return sensor
+}
+
+// Enables change only the selected, supported events, and the global
+// enables show in the reading flags
+func TestSensorEventEnable(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		support uint8
+		req     []uint8
+		cc      uint8
+		flags   uint8
+		enabled [2]uint16
+	}{
+		{"no sensor number", EVENT_SUPPORT_PER_STATE, nil,
+			IPMI_REQUEST_DATA_LENGTH_INVALID_CC, 0xc0,
+			[2]uint16{0x0003, 0x0300}},
+		{"short", EVENT_SUPPORT_PER_STATE, []uint8{1},
+			IPMI_REQUEST_DATA_LENGTH_INVALID_CC, 0xc0,
+			[2]uint16{0x0003, 0x0300}},
+		{"unknown sensor", EVENT_SUPPORT_PER_STATE, []uint8{9, 0},
+			IPMI_NOT_PRESENT_CC, 0xc0, [2]uint16{0x0003, 0x0300}},
+		{"bad action", EVENT_SUPPORT_PER_STATE, []uint8{1, 0xf0},
+			IPMI_INVALID_DATA_FIELD_CC, 0xc0,
+			[2]uint16{0x0003, 0x0300}},
+		{"not per state", EVENT_SUPPORT_ENTIRE_SENSOR,
+			[]uint8{1, 0xd0, 0x01}, IPMI_INVALID_DATA_FIELD_CC, 0xc0,
+			[2]uint16{0x0003, 0x0300}},
+		{"global disable", EVENT_SUPPORT_ENTIRE_SENSOR,
+			[]uint8{1, 0x00}, 0, 0x00, [2]uint16{0x0003, 0x0300}},
+		{"scanning only", EVENT_SUPPORT_PER_STATE, []uint8{1, 0x40},
+			0, 0x40, [2]uint16{0x0003, 0x0300}},
+		{"disable selected", EVENT_SUPPORT_PER_STATE,
+			[]uint8{1, 0xe0, 0x01, 0, 0, 0x01}, 0, 0xc0,
+			[2]uint16{0x0002, 0x0200}},
+		{"no deassertion mask", EVENT_SUPPORT_PER_STATE,
+			[]uint8{1, 0xe0, 0x02}, 0, 0xc0,
+			[2]uint16{0x0001, 0x0300}},
+		{"enable unsupported", EVENT_SUPPORT_PER_STATE,
+			[]uint8{1, 0xd0, 0xff, 0xff, 0xff, 0xff}, 0, 0xc0,
+			[2]uint16{0x0003, 0x0300}},
+	} {
+		sensor := testEventSensorAdd(t)
+		sensor.eventSupport = c.support
+
+		rsp := testMsgRun(t, testMsgBuild(SENSOR_EVENT_NETFN,
+			SET_SENSOR_EVENT_ENABLE_CMD, c.req), setSensorEventEnable)
+		if rsp[0] != c.cc {
+			t.Errorf("%s: completion code %#x", c.name, rsp[0])
+		}
+		rsp = testMsgRun(t, testMsgBuild(SENSOR_EVENT_NETFN,
+			GET_SENSOR_EVENT_ENABLE_CMD, []uint8{1}),
+			getSensorEventEnable)
+		if len(rsp) != 6 || rsp[0] != 0 || rsp[1] != c.flags ||
+			binary.LittleEndian.Uint16(rsp[2:]) != c.enabled[0] ||
+			binary.LittleEndian.Uint16(rsp[4:]) != c.enabled[1] {
+			t.Errorf("%s: get response % x", c.name, rsp)
+		}
+		rsp = testMsgRun(t, testMsgBuild(SENSOR_EVENT_NETFN,
+			GET_SENSOR_READING_CMD, []uint8{1}), getSensorReading)
+		if rsp[0] != 0 || rsp[2]&0xc0 != c.flags {
+			t.Errorf("%s: reading response % x", c.name, rsp)
+		}
+	}
+}
+
+// Rearm clears all latched status or just the selected bits, which
+// Get Sensor Event Status then leaves out
+func TestRearmSensorEvents(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		req     []uint8
+		cc      uint8
+		latched [2]uint16
+	}{
+		{"no sensor number", nil, IPMI_REQUEST_DATA_LENGTH_INVALID_CC,
+			[2]uint16{0x0003, 0x0300}},
+		{"short", []uint8{1}, IPMI_REQUEST_DATA_LENGTH_INVALID_CC,
+			[2]uint16{0x0003, 0x0300}},
+		{"unknown sensor", []uint8{9, 0}, IPMI_NOT_PRESENT_CC,
+			[2]uint16{0x0003, 0x0300}},
+		{"all", []uint8{1, 0x00}, 0, [2]uint16{}},
+		{"selected", []uint8{1, 0x80, 0x01, 0, 0, 0x01}, 0,
+			[2]uint16{0x0002, 0x0200}},
+		{"no deassertion mask", []uint8{1, 0x80, 0x02}, 0,
+			[2]uint16{0x0001, 0x0300}},
+	} {
+		sensor := testEventSensorAdd(t)
+		sensor.eventLatched = [2]uint16{0x0003, 0x0300}
+
+		rsp := testMsgRun(t, testMsgBuild(SENSOR_EVENT_NETFN,
+			REARM_SENSOR_EVENTS_CMD, c.req), rearmSensorEvents)
+		if rsp[0] != c.cc {
+			t.Errorf("%s: completion code %#x", c.name, rsp[0])
+		}
+		rsp = testMsgRun(t, testMsgBuild(SENSOR_EVENT_NETFN,
+			GET_SENSOR_EVENT_STATUS_CMD, []uint8{1}),
+			getSensorEventStatus)
+		if len(rsp) != 6 || rsp[0] != 0 || rsp[1]&0xc0 != 0xc0 ||
+			binary.LittleEndian.Uint16(rsp[2:]) != c.latched[0] ||
+			binary.LittleEndian.Uint16(rsp[4:]) != c.latched[1] {
+			t.Errorf("%s: status response % x", c.name, rsp)
+		}
+	}
+}
+
+// Linear sensors answer with their sdr factors, non-linear ones with
+// the range of their table holding the reading
+func TestGetSensorReadingFactors(t *testing.T) {
+	low := sdrFactorsT{m: 1, rExp: -1}
+	high := sdrFactorsT{m: 300, b: -2, bExp: 1, rExp: -2}
+	table := sdrFactorsTableT{{0, low}, {0x80, high}}
+
+	for _, c := range []struct {
+		name    string
+		linear  uint8
+		code    uint8
+		table   sdrFactorsTableT
+		req     []uint8
+		cc      uint8
+		next    uint8
+		factors *sdrFactorsT
+	}{
+		{"no sensor number", SDR_LINEAR, THRESHOLD_EVENT_TYPE, nil,
+			nil, IPMI_REQUEST_DATA_LENGTH_INVALID_CC, 0, nil},
+		{"no reading", SDR_LINEAR, THRESHOLD_EVENT_TYPE, nil,
+			[]uint8{1}, IPMI_REQUEST_DATA_LENGTH_INVALID_CC, 0, nil},
+		{"unknown sensor", SDR_LINEAR, THRESHOLD_EVENT_TYPE, nil,
+			[]uint8{9, 0}, IPMI_NOT_PRESENT_CC, 0, nil},
+		{"discrete", SDR_LINEAR, 0x6f, nil, []uint8{1, 0},
+			IPMI_COMMAND_ILLEGAL_FOR_SENSOR_CC, 0, nil},
+		{"linear", SDR_LINEAR, THRESHOLD_EVENT_TYPE, nil,
+			[]uint8{1, 0x10}, 0, 0xff, nil},
+		{"no table", SDR_NON_LINEAR, THRESHOLD_EVENT_TYPE, nil,
+			[]uint8{1, 0x10}, IPMI_COMMAND_ILLEGAL_FOR_SENSOR_CC, 0,
+			nil},
+		{"low range", SDR_NON_LINEAR, THRESHOLD_EVENT_TYPE, table,
+			[]uint8{1, 0x10}, 0, 0x80, &low},
+		{"high range", SDR_NON_LINEAR, THRESHOLD_EVENT_TYPE, table,
+			[]uint8{1, 0x80}, 0, 0xff, &high},
+	} {
+		mcTestReset(t)
+		root := t.TempDir()
+		testTreeWrite(t, root, testHwmonTree)
+		hwmonSensorsAdd(root)
+		sensor := mc.sensors[0][1]
+		sensor.eventReadingCode = c.code
+		sensor.factors = c.table
+		sensor.sdr.data[23] = c.linear
+
+		rsp := testMsgRun(t, testMsgBuild(SENSOR_EVENT_NETFN,
+			GET_SENSOR_READING_FACTORS_CMD, c.req),
+			getSensorReadingFactors)
+		if rsp[0] != c.cc {
+			t.Errorf("%s: completion code %#x", c.name, rsp[0])
+			continue
+		}
+		if c.cc != 0 {
+			continue
+		}
+		want := sensor.sdr.data[24:30]
+		if c.factors != nil {
+			fb := c.factors.bytes()
+			want = fb[:]
+		}
+		if len(rsp) != 8 || rsp[1] != c.next ||
+			!bytes.Equal(rsp[2:], want) {
+			t.Errorf("%s: response % x", c.name, rsp)
+		}
+	}
+}
+
+// Any sensor of ours can have its type changed, and one with an sdr
+// has the record saved with the new type
+func TestSensorType(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		set   []uint8
+		setCc uint8
+		get   []uint8
+		getCc uint8
+		typ   [2]uint8
+		saved bool
+	}{
+		{"no sensor number", nil, IPMI_REQUEST_DATA_LENGTH_INVALID_CC,
+			nil, IPMI_REQUEST_DATA_LENGTH_INVALID_CC, [2]uint8{},
+			false},
+		{"short", []uint8{1, 2}, IPMI_REQUEST_DATA_LENGTH_INVALID_CC,
+			[]uint8{1}, 0, [2]uint8{2, THRESHOLD_EVENT_TYPE}, false},
+		{"unknown sensor", []uint8{9, 4, 5}, IPMI_NOT_PRESENT_CC,
+			[]uint8{9}, IPMI_NOT_PRESENT_CC, [2]uint8{}, false},
+		{"with sdr", []uint8{1, 4, 0x85}, 0, []uint8{1}, 0,
+			[2]uint8{4, 5}, true},
+		{"without sdr", []uint8{20, 0xc0, 0x70}, 0, []uint8{20}, 0,
+			[2]uint8{0xc0, 0x70}, false},
+	} {
+		mcTestReset(t)
+		root := t.TempDir()
+		testTreeWrite(t, root, testHwmonTree)
+		hwmonSensorsAdd(root)
+		mc.sensors[0][20] = &sensorT{num: 20, sensorType: 0xc0,
+			eventReadingCode: 0x6f}
+		mc.mainSdrs.dirty = false
+
+		rsp := testMsgRun(t, testMsgBuild(SENSOR_EVENT_NETFN,
+			SET_SENSOR_TYPE_CMD, c.set), setSensorType)
+		if rsp[0] != c.setCc {
+			t.Errorf("%s: set completion code %#x", c.name, rsp[0])
+		}
+		rsp = testMsgRun(t, testMsgBuild(SENSOR_EVENT_NETFN,
+			GET_SENSOR_TYPE_CMD, c.get), getSensorType)
+		if rsp[0] != c.getCc {
+			t.Errorf("%s: get completion code %#x", c.name, rsp[0])
+		} else if c.getCc == 0 && (len(rsp) != 3 ||
+			[2]uint8{rsp[1], rsp[2]} != c.typ) {
+			t.Errorf("%s: get response % x", c.name, rsp)
+		}
+		if !c.saved {
+			if mc.mainSdrs.dirty {
+				t.Errorf("%s: repository changed", c.name)
+			}
+			continue
+		}
+
+		testSdrsReload(t)
+		entry := sdrFind(0, 1)
+		if entry == nil ||
+			[2]uint8{entry.data[12], entry.data[13]} != c.typ {
+			t.Errorf("%s: type not saved", c.name)
+		}
+	}
+}
+
+// Add the test hwmon sensors, the last moved to lun 1, and a proxy
+// for an LC sensor that isn't one of ours
+func testDeviceSdrsAdd(t *testing.T) {
+	mcTestReset(t)
+	root := t.TempDir()
+	testTreeWrite(t, root, testHwmonTree)
+	hwmonSensorsAdd(root)
+	entry := sdrFind(0, 3)
+	entry.lun = 1
+	mc.sensors[1][3], mc.sensors[0][3] = mc.sensors[0][3], nil
+	mainSdrAdd(&FullSensorSdr{SdrSensor: SdrSensor{
+		OwnerId: cardIpmbAddr(1), Number: 40}, SensorType: 1,
+		EventReadingType: THRESHOLD_EVENT_TYPE, SdrId: sdrId("1temp")})
+}
+
+// Device sdr info counts only our own sensors, by lun or in all
+func TestGetDeviceSdrInfo(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		req   []uint8
+		count uint8
+	}{
+		{"no operation", nil, 2},
+		{"sensor count", []uint8{0}, 2},
+		{"sdr count", []uint8{1}, 3},
+	} {
+		testDeviceSdrsAdd(t)
+		rsp := testMsgRun(t, testMsgBuild(SENSOR_EVENT_NETFN,
+			GET_DEVICE_SDR_INFO_CMD, c.req), getDeviceSdrInfo)
+		if len(rsp) != 7 || rsp[0] != 0 || rsp[1] != c.count ||
+			rsp[2] != 0x83 || binary.LittleEndian.Uint32(rsp[3:]) !=
+			mc.deviceSdrChangeTime {
+			t.Errorf("%s: response % x", c.name, rsp)
+		}
+	}
+}
+
+// Device sdrs are read whole without a reservation and in part with
+// one, skipping records that aren't ours
+func TestGetDeviceSdr(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		reserve  bool
+		req      []uint8
+		cc       uint8
+		recordId uint16
+		next     uint16
+		offset   uint16
+	}{
+		{"short", false, []uint8{0, 0, 0, 0, 0},
+			IPMI_REQUEST_DATA_LENGTH_INVALID_CC, 0, 0, 0},
+		{"first", false, []uint8{0, 0, 0, 0, 0, 0xff}, 0, 1, 2, 0},
+		{"by id", false, []uint8{0, 0, 2, 0, 0, 0xff}, 0, 2, 3, 0},
+		{"last", false, []uint8{0, 0, 0xff, 0xff, 0, 0xff}, 0, 3,
+			0xffff, 0},
+		{"not ours", false, []uint8{0, 0, 4, 0, 0, 0xff},
+			IPMI_NOT_PRESENT_CC, 0, 0, 0},
+		{"stale reservation", false, []uint8{5, 0, 1, 0, 0, 0xff},
+			IPMI_INVALID_RESERVATION_CC, 0, 0, 0},
+		{"partial without reservation", false,
+			[]uint8{0, 0, 1, 0, 5, 4}, IPMI_INVALID_RESERVATION_CC,
+			0, 0, 0},
+		{"partial", true, []uint8{0, 0, 1, 0, 5, 4}, 0, 1, 2, 5},
+		{"offset past end", true, []uint8{0, 0, 1, 0, 0xfe, 4},
+			IPMI_PARAMETER_OUT_OF_RANGE_CC, 0, 0, 0},
+	} {
+		testDeviceSdrsAdd(t)
+		if c.reserve {
+			rsp := testMsgRun(t, testMsgBuild(SENSOR_EVENT_NETFN,
+				RESERVE_DEVICE_SDR_REPOSITORY_CMD, nil),
+				reserveDeviceSdrRepository)
+			copy(c.req[0:2], rsp[1:3])
+		}
+
+		rsp := testMsgRun(t, testMsgBuild(SENSOR_EVENT_NETFN,
+			GET_DEVICE_SDR_CMD, c.req), getDeviceSdr)
+		if rsp[0] != c.cc {
+			t.Errorf("%s: completion code %#x", c.name, rsp[0])
+			continue
+		}
+		if c.cc != 0 {
+			continue
+		}
+		entry, _ := sdrEntryFind(c.recordId)
+		count := uint16(c.req[5])
+		if c.offset+count > entry.length {
+			count = entry.length - c.offset
+		}
+		if binary.LittleEndian.Uint16(rsp[1:3]) != c.next ||
+			!bytes.Equal(rsp[3:],
+				entry.data[c.offset:c.offset+count]) {
+			t.Errorf("%s: response % x", c.name, rsp)
+		}
+	}
+}
+
+// Each reservation, or a change in our sensors, cancels the last one
+func TestReserveDeviceSdrRepository(t *testing.T) {
+	testDeviceSdrsAdd(t)
+	mc.deviceSdrReservation = 0xfffe
+	for _, want := range []uint16{0xffff, 1, 2} {
+		rsp := testMsgRun(t, testMsgBuild(SENSOR_EVENT_NETFN,
+			RESERVE_DEVICE_SDR_REPOSITORY_CMD, nil),
+			reserveDeviceSdrRepository)
+		if len(rsp) != 3 || rsp[0] != 0 ||
+			binary.LittleEndian.Uint16(rsp[1:]) != want {
+			t.Errorf("reservation % x, want %#x", rsp, want)
+		}
+	}
+
+	deviceSdrsChanged()
+	rsp := testMsgRun(t, testMsgBuild(SENSOR_EVENT_NETFN,
+		GET_DEVICE_SDR_CMD, []uint8{2, 0, 1, 0, 5, 4}), getDeviceSdr)
+	if rsp[0] != IPMI_INVALID_RESERVATION_CC {
+		t.Errorf("reservation kept across a change, % x", rsp)
+	}
+}
@@ -8,6 +8,7 @@ package ipmigod
 import (
 	"encoding/binary"
 	"fmt"
+	"os"
 	"time"
 )
 
@@ -16,6 +17,35 @@ const (
 	MAX_NUM_SDRS   = 1024
 )
 
+// Partial add sdr: record length in the header doesn't match the
+// number of bytes written
+const IPMI_SDR_LENGTH_MISMATCH_CC = 0x80
+
+// Repository space is handed out in 16 byte allocation units
+const (
+	SDR_ALLOC_UNIT_SIZE = 16
+	SDR_ALLOC_UNITS     = MAX_NUM_SDRS * 64 / SDR_ALLOC_UNIT_SIZE
+)
+
+// Saved sdr repository, the version changes with its layout
+const (
+	SDR_STATE_FILE    = "sdrs.json"
+	SDR_STATE_VERSION = 1
+	SDR_SAVE_INTERVAL = time.Second
+)
+
+// Clear sdr repository erasure progress
+const (
+	SDR_ERASE_IN_PROGRESS = 0
+	SDR_ERASE_COMPLETED   = 1
+)
+
+// Partial add sdr in progress byte
+const (
+	SDR_PARTIAL_IN_PROGRESS = 0
+	SDR_PARTIAL_LAST        = 1
+)
+
 func getFruInventoryAreaInfo(msg *msgT) {
 	fmt.Println("storageNetfn not supported", msg.rmcp.message.cmd)
 }
@@ -34,11 +64,15 @@ func getSdrRepositoryInfo(msg *msgT) {
 	data[0] = 0
 	data[1] = 0x51
 	binary.LittleEndian.PutUint16(data[2:4], mc.mainSdrs.sdrCount)
-	space := MAX_SDR_LENGTH * (MAX_NUM_SDRS - mc.mainSdrs.sdrCount)
+	space := 0
+	used := int(sdrUsedAllocUnits())
+	if used < SDR_ALLOC_UNITS {
+		space = (SDR_ALLOC_UNITS - used) * SDR_ALLOC_UNIT_SIZE
+	}
 	if space > 0xfffe {
 		space = 0xfffe
 	}
-	binary.LittleEndian.PutUint16(data[4:6], space)
+	binary.LittleEndian.PutUint16(data[4:6], uint16(space))
 	binary.LittleEndian.PutUint32(data[6:10],
 		mc.mainSdrs.lastAddTime)
 	binary.LittleEndian.PutUint32(data[10:14],
@@ -48,8 +82,38 @@ func getSdrRepositoryInfo(msg *msgT) {
 	msg.returnRspData(nil, data[0:15], 15)
 }
 
+// Allocation units taken by a record
+func sdrAllocUnits(length uint16) uint16 {
+	return (length + SDR_ALLOC_UNIT_SIZE - 1) / SDR_ALLOC_UNIT_SIZE
+}
+
+func sdrUsedAllocUnits() uint16 {
+	var used uint16
+
+	for entry := mc.mainSdrs.sdrs; entry != nil; entry = entry.next {
+		used += sdrAllocUnits(entry.length)
+	}
+	return used
+}
+
 func getSdrRepositoryAllocInfo(msg *msgT) {
-	fmt.Println("storageNetfn not supported", msg.rmcp.message.cmd)
+	var data [10]uint8
+
+	free := uint16(0)
+	used := sdrUsedAllocUnits()
+	if used < SDR_ALLOC_UNITS {
+		free = SDR_ALLOC_UNITS - used
+	}
+
+	// Records live in memory so the free space is never fragmented
+	data[0] = 0
+	binary.LittleEndian.PutUint16(data[1:3], SDR_ALLOC_UNITS)
+	binary.LittleEndian.PutUint16(data[3:5], SDR_ALLOC_UNIT_SIZE)
+	binary.LittleEndian.PutUint16(data[5:7], free)
+	binary.LittleEndian.PutUint16(data[7:9], free)
+	data[9] = uint8(sdrAllocUnits(MAX_SDR_LENGTH))
+
+	msg.returnRspData(nil, data[0:10], 10)
 }
 
 func reserveSdrRepository(msg *msgT) {
@@ -73,6 +137,15 @@ func getSdr(msg *msgT) {
 		entry *sdrT
 	)
 
+	if mc.mainSdrs.updateMode {
+		msg.returnErr(nil, IPMI_REPOSITORY_IN_UPDATE_MODE_CC)
+		return
+	}
+	if msg.reqDataLen() < 6 {
+		msg.returnErr(nil, IPMI_REQUEST_DATA_LENGTH_INVALID_CC)
+		return
+	}
+
 	dataStart := msg.dataStart
 	reservation :=
 		binary.LittleEndian.Uint16(msg.data[dataStart : dataStart+2])
@@ -86,23 +159,10 @@ func getSdr(msg *msgT) {
 
 	recordId :=
 		binary.LittleEndian.Uint16(msg.data[dataStart+2 : dataStart+4])
-	offset := msg.data[dataStart+4]
-	count := msg.data[dataStart+5]
-
-	if recordId == 0 {
-		entry = mc.mainSdrs.sdrs
-	} else if recordId == 0xffff {
-		entry = mc.mainSdrs.tailSdr
-	} else {
-		entry = mc.mainSdrs.sdrs
-		for entry != nil {
-			if entry.recordId == recordId {
-				break
-			}
-			entry = entry.next
-		}
-	}
+	offset := uint16(msg.data[dataStart+4])
+	count := uint16(msg.data[dataStart+5])
 
+	entry, _ = sdrEntryFind(recordId)
 	if entry == nil {
 		fmt.Println("getSdr: Can't find recordId", recordId)
 		msg.returnErr(nil, IPMI_NOT_PRESENT_CC)
@@ -141,15 +201,35 @@ func getSdr(msg *msgT) {
 	msg.returnRspData(nil, data[0:], uint(count+3))
 }
 
-func newSdrEntry(length uint8) *sdrT {
+// Hand out the next record id not in use. Ids count up from the last
+// one handed out, so a deleted record's id isn't reused straight away,
+// and skip 0 and 0xffff which get sdr takes as first and last.
+func sdrIdAlloc() (uint16, bool) {
+	for tries := 0; tries <= 0xffff; tries++ {
+		recordId := mc.mainSdrs.nextFreeEntryId
+		mc.mainSdrs.nextFreeEntryId++
+		if recordId == 0 || recordId == 0xffff {
+			continue
+		}
+		if partial := mc.mainSdrs.partial; partial != nil &&
+			partial.recordId == recordId {
+			continue
+		}
+		if entry, _ := sdrEntryFind(recordId); entry == nil {
+			return recordId, true
+		}
+	}
+	return 0, false
+}
 
-	newSdr := new(sdrT)
-	if newSdr == nil {
+func newSdrEntry(length uint8) *sdrT {
+	recordId, ok := sdrIdAlloc()
+	if !ok {
 		return nil
 	}
-	newSdr.recordId = mc.mainSdrs.nextFreeEntryId
-	mc.mainSdrs.nextFreeEntryId++
-	newSdr.length = length + 5
+	newSdr := new(sdrT)
+	newSdr.recordId = recordId
+	newSdr.length = uint16(length) + 5
 
 	// Have to update record data to reflect local MM state
 	if chassisCardNum == 0 {
@@ -159,20 +239,217 @@ func newSdrEntry(length uint8) *sdrT {
 	return newSdr
 }
 
+// Add a record written by a requester, a local sensor's record
+// configures the sensor as one of ours would
 func addSdrEntry(newSdr *sdrT) {
-	if mc.mainSdrs.sdrs == nil {
-		mc.mainSdrs.sdrs = newSdr
-	} else {
-		mc.mainSdrs.tailSdr.next = newSdr
-	}
 	if debug {
 		fmt.Println("addSdrEntry: ", newSdr.recordId)
 	}
-	mc.mainSdrs.tailSdr = newSdr
-	now := time.Now()
-	nowUnix := uint32(now.Unix())
-	mc.sel.lastAddTime = nowUnix
-	mc.mainSdrs.sdrCount++
+	mc.mainSdrs.link(newSdr)
+	sdrLocalTie(newSdr)
+}
+
+// Any change to the set of records cancels outstanding reservations
+func (sdrs *sdrsT) reservationCancel() {
+	sdrs.reservation++
+	if sdrs.reservation == 0 {
+		sdrs.reservation++
+	}
+}
+
+// Add an entry at the tail
+func (sdrs *sdrsT) link(entry *sdrT) {
+	if sdrs.sdrs == nil {
+		sdrs.sdrs = entry
+	} else {
+		sdrs.tailSdr.next = entry
+	}
+	sdrs.tailSdr = entry
+	sdrs.sdrCount++
+	sdrs.lastAddTime = sdrRepositoryTime()
+	sdrs.reservationCancel()
+	sdrs.dirty = true
+}
+
+// Refresh an entry with a new copy of its record, the record id stays.
+// A change counts as an add.
+func (sdrs *sdrsT) update(entry *sdrT, record []uint8) {
+	if int(entry.length) == len(record) &&
+		string(entry.data[2:entry.length]) == string(record[2:]) {
+		return
+	}
+	entry.length = uint16(len(record))
+	copy(entry.data[2:entry.length], record[2:])
+	sdrs.lastAddTime = sdrRepositoryTime()
+	sdrs.reservationCancel()
+	sdrs.dirty = true
+}
+
+// Remove an entry given the one ahead of it
+func (sdrs *sdrsT) unlink(entry *sdrT, prev *sdrT) {
+	if prev == nil {
+		sdrs.sdrs = entry.next
+	} else {
+		prev.next = entry.next
+	}
+	if sdrs.tailSdr == entry {
+		sdrs.tailSdr = prev
+	}
+	entry.next = nil
+	sdrs.sdrCount--
+	sdrs.lastEraseTime = sdrRepositoryTime()
+	sdrs.reservationCancel()
+	sdrs.dirty = true
+	sdrLocalUntie(entry)
+}
+
+// Drop every record, along with any partial add in progress
+func (sdrs *sdrsT) erase() {
+	for entry := sdrs.sdrs; entry != nil; entry = entry.next {
+		sdrLocalUntie(entry)
+	}
+	sdrs.sdrs = nil
+	sdrs.tailSdr = nil
+	sdrs.partial = nil
+	sdrs.sdrCount = 0
+	sdrs.lastEraseTime = sdrRepositoryTime()
+	sdrs.reservationCancel()
+	sdrs.dirty = true
+}
+
+// Repository as saved in SDR_STATE_FILE. Record ids are kept so that
+// tools caching sdrs by record id stay valid across restarts.
+type sdrsSavedT struct {
+	Version         int
+	NextFreeEntryId uint16
+	LastAddTime     uint32
+	LastEraseTime   uint32
+	TimeOffset      uint64
+	Records         [][]uint8
+}
+
+func sdrsSave() {
+	saved := sdrsSavedT{
+		Version:         SDR_STATE_VERSION,
+		NextFreeEntryId: mc.mainSdrs.nextFreeEntryId,
+		LastAddTime:     mc.mainSdrs.lastAddTime,
+		LastEraseTime:   mc.mainSdrs.lastEraseTime,
+		TimeOffset:      mc.mainSdrs.timeOffset,
+	}
+	for entry := mc.mainSdrs.sdrs; entry != nil; entry = entry.next {
+		saved.Records = append(saved.Records,
+			append([]uint8(nil), entry.data[:entry.length]...))
+	}
+	err := stateSave(SDR_STATE_FILE, &saved)
+	if err != nil {
+		fmt.Println("sdrsSave:", err)
+	}
+}
+
+// Save the repository if it changed. Called from the main loop, which
+// makes the changes, every SDR_SAVE_INTERVAL so a burst of changes is
+// written once.
+func sdrsSaveRun() {
+	if mc.mainSdrs.dirty {
+		mc.mainSdrs.dirty = false
+		sdrsSave()
+	}
+}
+
+// Restore the saved repository. Local sensors are tied to their
+// records again as they are added.
+func sdrsLoad() {
+	var saved sdrsSavedT
+
+	err := stateLoad(SDR_STATE_FILE, &saved)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Println("sdrsLoad:", err)
+		}
+		return
+	}
+	if saved.Version != SDR_STATE_VERSION {
+		fmt.Println("sdrsLoad: unknown version", saved.Version)
+		return
+	}
+
+	mc.mainSdrs.timeOffset = saved.TimeOffset
+	for _, record := range saved.Records {
+		_, err := UnmarshalSdr(record)
+		if err != nil || len(record) > MAX_SDR_LENGTH {
+			fmt.Println("sdrsLoad: bad record", err)
+			continue
+		}
+		entry := new(sdrT)
+		entry.recordId = binary.LittleEndian.Uint16(record[0:2])
+		if entry.recordId == 0 || entry.recordId == 0xffff {
+			continue
+		}
+		if found, _ := sdrEntryFind(entry.recordId); found != nil {
+			fmt.Println("sdrsLoad: duplicate record", entry.recordId)
+			continue
+		}
+		entry.length = uint16(len(record))
+		copy(entry.data[:], record)
+		sdrKeySet(entry)
+		entry.enabled = true
+		entry.eventsEnabled = true
+		entry.scanningEnabled = true
+		mc.mainSdrs.link(entry)
+		if entry.recordId >= saved.NextFreeEntryId {
+			saved.NextFreeEntryId = entry.recordId + 1
+		}
+	}
+	if saved.NextFreeEntryId > mc.mainSdrs.nextFreeEntryId {
+		mc.mainSdrs.nextFreeEntryId = saved.NextFreeEntryId
+	}
+	mc.mainSdrs.lastAddTime = saved.LastAddTime
+	mc.mainSdrs.lastEraseTime = saved.LastEraseTime
+	mc.mainSdrs.dirty = false
+}
+
+// Is there room for another record of length bytes
+func (sdrs *sdrsT) spaceFor(length uint16) bool {
+	return sdrs.sdrCount < sdrs.maxSdrCount &&
+		sdrUsedAllocUnits()+sdrAllocUnits(length) <= SDR_ALLOC_UNITS
+}
+
+// Bytes after the header that identify a locator record
+var sdrLocatorKeyLen = map[uint8]int{
+	SDR_GENERIC_DEV_LOCATOR: 3, // access/slave address, lun/bus
+	SDR_FRU_DEV_LOCATOR:     4, // address, FRU id, lun/bus, channel
+	SDR_MC_DEV_LOCATOR:      2, // slave address, channel
+}
+
+// Find the entry a record would duplicate. Sensor records match on
+// owner lun and sensor number, locators on the device they locate and
+// other records on their whole contents.
+func sdrDuplicate(record []uint8) *sdrT {
+	recordType := record[3]
+	keyLen, isLocator := sdrLocatorKeyLen[recordType]
+	for entry := mc.mainSdrs.sdrs; entry != nil; entry = entry.next {
+		if sdrRecordType(entry) != recordType {
+			continue
+		}
+		switch {
+		case sdrIsSensor(entry):
+			if entry.lun == record[6]&3 &&
+				entry.sensNum == record[7] {
+				return entry
+			}
+		case isLocator:
+			if string(entry.data[5:5+keyLen]) ==
+				string(record[5:5+keyLen]) {
+				return entry
+			}
+		default:
+			if string(entry.data[5:entry.length]) ==
+				string(record[5:]) {
+				return entry
+			}
+		}
+	}
+	return nil
 }
 
 func addSdr(msg *msgT) {
@@ -181,95 +458,270 @@ func addSdr(msg *msgT) {
 		entry *sdrT
 	)
 
-	// Points directly into full SDR record data
+	// Request data is the whole SDR record, of any type
 	dataStart := msg.dataStart
-	lun := msg.data[dataStart+6]
-	sensNum := msg.data[dataStart+7]
-	value := msg.data[dataStart+46]
-
-	// If oem field is 0 we have a regular addSdr otherwise
-	// it's really a sensor value update
-	if msg.data[dataStart+46] == 0 {
-		if debug {
-			fmt.Printf("Received addSdr: % x\n",
-				msg.data[0:msg.dataLen])
-		}
+	reqLen := msg.reqDataLen()
+	if reqLen < 5 || uint(msg.data[dataStart+4])+5 > reqLen {
+		msg.returnErr(nil, IPMI_REQUEST_DATA_LENGTH_INVALID_CC)
+		return
+	}
+	record := msg.data[dataStart : dataStart+uint(msg.data[dataStart+4])+5]
+	decoded, err := UnmarshalSdr(record)
+	if err != nil {
+		msg.returnErr(nil, IPMI_INVALID_DATA_FIELD_CC)
+		return
+	}
+	sensorRecord, isSensor := decoded.(sensorSdr)
 
-		// check for duplicate SDRs
-		entry = mc.mainSdrs.sdrs
-		for entry != nil {
-			if entry.lun == lun &&
-				entry.sensNum == sensNum {
-				data[0] = 0
-				binary.LittleEndian.PutUint16(data[1:3],
-					entry.recordId)
-				msg.returnRspData(nil, data[0:3], 3)
-				return
-			}
-			entry = entry.next
-		}
+	// Any sensor sdr traffic from an LC shows it's present
+	if isSensor && lcAddrKnown(msg.remoteAddr) {
+		cardSeen(sensorRecord.sensorKey())
+	}
 
-		entry = newSdrEntry(msg.data[dataStart+4])
-		if entry == nil {
-			msg.returnErr(nil, IPMI_OUT_OF_SPACE_CC)
-			return
-		}
-		// Update Sensor number from msg
-		entry.sensNum = msg.data[dataStart+7]
-		copy(entry.data[2:2+entry.length],
-			msg.data[dataStart+2:dataStart+2+uint(entry.length)])
-		entry.enabled = true
-		entry.eventsEnabled = true
-		entry.scanningEnabled = true
-		entry.eventStatus = 0
+	// If oem field is 0 and there's no update mark we have a regular
+	// addSdr otherwise it's really a sensor value update
+	if full, ok := decoded.(*FullSensorSdr); ok &&
+		(full.Oem != 0 || record[45]&SDR_VALUE_UPDATE != 0) {
+		sdrValueUpdate(msg, record)
+		return
+	}
 
-		addSdrEntry(entry)
+	if debug {
+		fmt.Printf("Received addSdr: % x\n", msg.data[0:msg.dataLen])
+	}
 
+	// check for duplicate SDRs, an LC re-adding one of its
+	// SDRs is refreshing our proxy copy
+	entry = sdrDuplicate(record)
+	if entry != nil {
+		mc.mainSdrs.update(entry, record)
 		data[0] = 0
 		binary.LittleEndian.PutUint16(data[1:3], entry.recordId)
 		msg.returnRspData(nil, data[0:3], 3)
-	} else {
-		if debug {
-			fmt.Printf("Received special addSdr: % x\n",
-				msg.data[0:msg.dataLen])
-		}
+		return
+	}
 
-		// Find sdr entry in local SDR database and update its value
-		entry = mc.mainSdrs.sdrs
-		for entry != nil {
-			if entry.lun == lun &&
-				entry.sensNum == sensNum {
-				entry.value = value
-				break
-			}
-			entry = entry.next
-		}
+	// Entity instance carries the LC card number; remember
+	// how to reach that LC for bridged requests.
+	if isSensor && chassisCardNum == 0 && msg.remoteAddr != nil {
+		ipmbRouteAdd(sensorRecord.sensorKey().EntityInstance,
+			msg.remoteAddr)
+	}
+
+	if !mc.mainSdrs.spaceFor(uint16(len(record))) {
+		msg.returnErr(nil, IPMI_OUT_OF_SPACE_CC)
+		return
+	}
+	entry = newSdrEntry(record[4])
+	if entry == nil {
+		msg.returnErr(nil, IPMI_OUT_OF_SPACE_CC)
+		return
+	}
+	copy(entry.data[2:entry.length], record[2:])
+	sdrKeySet(entry)
+	entry.enabled = true
+	entry.eventsEnabled = true
+	entry.scanningEnabled = true
+	entry.eventStatus = 0
+
+	addSdrEntry(entry)
+
+	data[0] = 0
+	binary.LittleEndian.PutUint16(data[1:3], entry.recordId)
+	msg.returnRspData(nil, data[0:3], 3)
+}
+
+// An LC's special addSdr. Find sdr entry in local SDR database and
+// update its value, threshold status and enables.
+func sdrValueUpdate(msg *msgT, record []uint8) {
+	var data [3]uint8
 
-		if entry != nil {
-			data[0] = 0
-			binary.LittleEndian.PutUint16(data[1:3],
-				entry.recordId)
-			msg.returnRspData(nil, data[0:3], 3)
+	if debug {
+		fmt.Printf("Received special addSdr: % x\n",
+			msg.data[0:msg.dataLen])
+	}
+
+	entry := sdrFind(record[6]&3, record[7])
+	if entry == nil {
+		msg.returnErr(nil, IPMI_NOT_PRESENT_CC)
+		return
+	}
+
+	// A proxy restored from the saved repository learns its
+	// route from the LC's updates
+	if chassisCardNum == 0 && msg.remoteAddr != nil {
+		ipmbRouteAdd(record[9], msg.remoteAddr)
+	}
+	entry.value = record[46]
+	entry.eventStatus = uint16(record[43])<<8 | uint16(record[44])
+	flags := record[45]
+	entry.eventsEnabled = flags&0x80 != 0
+	entry.scanningEnabled = flags&0x40 != 0
+	entry.readingUnavailable = flags&0x20 != 0
+
+	data[0] = 0
+	binary.LittleEndian.PutUint16(data[1:3], entry.recordId)
+	msg.returnRspData(nil, data[0:3], 3)
+}
+
+// Find an entry by record id, 0 being the first and 0xffff the last,
+// along with the entry ahead of it.
+func sdrEntryFind(recordId uint16) (entry *sdrT, prev *sdrT) {
+	if recordId == 0 {
+		return mc.mainSdrs.sdrs, nil
+	}
+	for entry = mc.mainSdrs.sdrs; entry != nil; entry = entry.next {
+		if entry.recordId == recordId ||
+			(recordId == 0xffff && entry.next == nil) {
+			break
 		}
+		prev = entry
 	}
+	return entry, prev
+}
+
+func sdrReservationCheck(msg *msgT) bool {
+	dataStart := msg.dataStart
+	reservation :=
+		binary.LittleEndian.Uint16(msg.data[dataStart : dataStart+2])
+	return reservation != 0 && reservation == mc.mainSdrs.reservation
 }
 
+// Records are written in fragments, the first one at offset 0 with
+// record id 0. Its response has the record id used for the rest. The
+// record is added once the last fragment makes it whole.
 func partialAddSdr(msg *msgT) {
-	fmt.Println("storageNetfn not supported", msg.rmcp.message.cmd)
+	var data [3]uint8
+
+	dataStart := msg.dataStart
+	reqLen := msg.reqDataLen()
+	if reqLen < 6 {
+		msg.returnErr(nil, IPMI_REQUEST_DATA_LENGTH_INVALID_CC)
+		return
+	}
+	if !sdrReservationCheck(msg) {
+		msg.returnErr(nil, IPMI_INVALID_RESERVATION_CC)
+		return
+	}
+	recordId :=
+		binary.LittleEndian.Uint16(msg.data[dataStart+2 : dataStart+4])
+	offset := uint16(msg.data[dataStart+4])
+	progress := msg.data[dataStart+5] & 0xf
+	fragment := msg.data[dataStart+6 : dataStart+reqLen]
+	if progress != SDR_PARTIAL_IN_PROGRESS && progress != SDR_PARTIAL_LAST {
+		msg.returnErr(nil, IPMI_INVALID_DATA_FIELD_CC)
+		return
+	}
+
+	// A first fragment abandons any record in progress
+	entry := mc.mainSdrs.partial
+	if recordId == 0 {
+		if offset != 0 {
+			msg.returnErr(nil, IPMI_PARAMETER_OUT_OF_RANGE_CC)
+			return
+		}
+		mc.mainSdrs.partial = nil
+		if mc.mainSdrs.sdrCount >= mc.mainSdrs.maxSdrCount {
+			msg.returnErr(nil, IPMI_OUT_OF_SPACE_CC)
+			return
+		}
+		recordId, ok := sdrIdAlloc()
+		if !ok {
+			msg.returnErr(nil, IPMI_OUT_OF_SPACE_CC)
+			return
+		}
+		entry = new(sdrT)
+		entry.recordId = recordId
+		mc.mainSdrs.partial = entry
+	} else if entry == nil || entry.recordId != recordId {
+		msg.returnErr(nil, IPMI_INVALID_DATA_FIELD_CC)
+		return
+	}
+
+	// Length holds the bytes written so far until the record is done
+	if offset != entry.length {
+		msg.returnErr(nil, IPMI_PARAMETER_OUT_OF_RANGE_CC)
+		return
+	}
+	if int(offset)+len(fragment) > MAX_SDR_LENGTH {
+		msg.returnErr(nil, IPMI_REQUEST_DATA_LENGTH_INVALID_CC)
+		return
+	}
+	copy(entry.data[offset:], fragment)
+	entry.length += uint16(len(fragment))
+
+	if progress == SDR_PARTIAL_LAST {
+		mc.mainSdrs.partial = nil
+		if entry.length < 5 ||
+			entry.length != uint16(entry.data[4])+5 {
+			msg.returnErr(nil, IPMI_SDR_LENGTH_MISMATCH_CC)
+			return
+		}
+		_, err := UnmarshalSdr(entry.data[:entry.length])
+		if err != nil {
+			msg.returnErr(nil, IPMI_INVALID_DATA_FIELD_CC)
+			return
+		}
+		if !mc.mainSdrs.spaceFor(entry.length) {
+			msg.returnErr(nil, IPMI_OUT_OF_SPACE_CC)
+			return
+		}
+		binary.LittleEndian.PutUint16(entry.data[:2], entry.recordId)
+		sdrKeySet(entry)
+		entry.enabled = true
+		entry.eventsEnabled = true
+		entry.scanningEnabled = true
+		addSdrEntry(entry)
+	}
+
+	data[0] = 0
+	binary.LittleEndian.PutUint16(data[1:3], entry.recordId)
+	msg.returnRspData(nil, data[0:3], 3)
 }
 
 func deleteSdr(msg *msgT) {
-	fmt.Println("storageNetfn not supported", msg.rmcp.message.cmd)
+	var data [3]uint8
+
+	dataStart := msg.dataStart
+	if msg.reqDataLen() < 4 {
+		msg.returnErr(nil, IPMI_REQUEST_DATA_LENGTH_INVALID_CC)
+		return
+	}
+	if !sdrReservationCheck(msg) {
+		msg.returnErr(nil, IPMI_INVALID_RESERVATION_CC)
+		return
+	}
+	recordId :=
+		binary.LittleEndian.Uint16(msg.data[dataStart+2 : dataStart+4])
+
+	entry, prev := sdrEntryFind(recordId)
+	if entry == nil {
+		msg.returnErr(nil, IPMI_NOT_PRESENT_CC)
+		return
+	}
+	mc.mainSdrs.unlink(entry, prev)
+
+	data[0] = 0
+	binary.LittleEndian.PutUint16(data[1:3], entry.recordId)
+	msg.returnRspData(nil, data[0:3], 3)
 }
 
+// The erase is scheduled on the main loop and reported in progress
+// until it's done. The requester polls with op 0, which also takes the
+// reservation the erase was started with as the erase cancels it.
 func clearSdrRepository(msg *msgT) {
-	var entry, n_entry *sdrT
-
 	var data [2]uint8
+
 	dataStart := msg.dataStart
+	if msg.reqDataLen() < 6 {
+		msg.returnErr(nil, IPMI_REQUEST_DATA_LENGTH_INVALID_CC)
+		return
+	}
 	reservation :=
 		binary.LittleEndian.Uint16(msg.data[dataStart : dataStart+2])
-	if (reservation != 0) && (reservation != mc.mainSdrs.reservation) {
+	op := msg.data[dataStart+5]
+	if !sdrReservationCheck(msg) && (op != 0 || reservation == 0 ||
+		reservation != mc.mainSdrs.eraseReservation) {
 		msg.returnErr(nil, IPMI_INVALID_RESERVATION_CC)
 		return
 	}
@@ -281,49 +733,97 @@ func clearSdrRepository(msg *msgT) {
 		return
 	}
 
-	op := msg.data[dataStart+5]
 	if op != 0 && op != 0xaa {
 		msg.returnErr(nil, IPMI_INVALID_DATA_FIELD_CC)
 		return
 	}
 
-	data[0] = 0
-	data[1] = 1
-	if op == 0xaa {
-		entry = mc.mainSdrs.sdrs
-		for entry != nil {
-			n_entry = entry.next
-			// free implicit - garbage collector should free
-			entry = n_entry
+	if op == 0xaa && !mc.mainSdrs.erasing {
+		mc.mainSdrs.erasing = true
+		mc.mainSdrs.eraseReservation = reservation
+		select {
+		case sdrErases <- struct{}{}:
+		default:
 		}
-		mc.mainSdrs.sdrs = nil
-		mc.mainSdrs.tailSdr = nil
-		now := time.Now()
-		nowUnix := uint32(now.Unix())
-		mc.mainSdrs.lastEraseTime = nowUnix
+	}
+	data[0] = 0
+	data[1] = SDR_ERASE_COMPLETED
+	if mc.mainSdrs.erasing {
+		data[1] = SDR_ERASE_IN_PROGRESS
 	}
 
 	msg.returnRspData(nil, data[0:2], 2)
 }
 
+// Erases started by Clear SDR Repository, run from the main loop
+var sdrErases = make(chan struct{}, 1)
+
+func sdrsEraseRun() {
+	if mc.mainSdrs.erasing {
+		mc.mainSdrs.erase()
+		mc.mainSdrs.erasing = false
+	}
+}
+
+// Repository clock, seconds since 1970 plus the offset left by a set
+// sdr repository time
+func sdrRepositoryTime() uint32 {
+	return uint32(uint64(time.Now().Unix()) + mc.mainSdrs.timeOffset)
+}
+
 func getSdrRepositoryTime(msg *msgT) {
-	fmt.Println("storageNetfn not supported", msg.rmcp.message.cmd)
+	var data [5]uint8
+
+	data[0] = 0
+	binary.LittleEndian.PutUint32(data[1:5], sdrRepositoryTime())
+	msg.returnRspData(nil, data[0:5], 5)
 }
 
 func setSdrRepositoryTime(msg *msgT) {
-	fmt.Println("storageNetfn not supported", msg.rmcp.message.cmd)
+	dataStart := msg.dataStart
+	if msg.reqDataLen() < 4 {
+		msg.returnErr(nil, IPMI_REQUEST_DATA_LENGTH_INVALID_CC)
+		return
+	}
+	t := binary.LittleEndian.Uint32(msg.data[dataStart : dataStart+4])
+	mc.mainSdrs.timeOffset = uint64(int64(t) - time.Now().Unix())
+	mc.mainSdrs.dirty = true
+
+	msg.returnErr(nil, 0)
 }
 
+// While in update mode sdrs can't be read, which lets a tool rewrite
+// the repository without readers seeing it half done.
 func enterSdrRepositoryUpdate(msg *msgT) {
-	fmt.Println("storageNetfn not supported", msg.rmcp.message.cmd)
+	mc.mainSdrs.updateMode = true
+	msg.returnErr(nil, 0)
 }
 
 func exitSdrRepositoryUpdate(msg *msgT) {
-	fmt.Println("storageNetfn not supported", msg.rmcp.message.cmd)
+	mc.mainSdrs.updateMode = false
+	msg.returnErr(nil, 0)
 }
 
+// Request bit 0 runs the agent, else just get its status. The agent
+// runs to completion before responding.
 func runInitializationAgent(msg *msgT) {
-	fmt.Println("storageNetfn not supported", msg.rmcp.message.cmd)
+	var data [2]uint8
+
+	if msg.reqDataLen() < 1 {
+		msg.returnErr(nil, IPMI_REQUEST_DATA_LENGTH_INVALID_CC)
+		return
+	}
+	if msg.data[msg.dataStart]&1 != 0 {
+		for _, sensor := range mc.sensorList {
+			if sensor.sdr != nil {
+				sensorInitAgent(sensor, sensor.sdr)
+			}
+		}
+	}
+
+	data[0] = 0
+	data[1] = 1 // completed
+	msg.returnRspData(nil, data[0:2], 2)
 }
 
 func getSelInfo(msg *msgT) {
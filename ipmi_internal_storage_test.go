@@ -0,0 +1,551 @@
+// Copyright 2015 Platina Systems, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style license described in the
+// LICENSE file.
+
+// Package contains IPMI 2.0 spec implementation
+package ipmigod
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func testOemSdr(n uint8) Sdr {
+	return &OemSdr{MfgId: [3]uint8{1, 2, 3}, Data: []uint8{n}}
+}
+
+// Record ids skip 0, 0xffff and ids still in use
+func TestSdrIdAlloc(t *testing.T) {
+	mcTestReset(t)
+	mainSdrAdd(testOemSdr(1))
+	mc.mainSdrs.nextFreeEntryId = 0xfffe
+
+	var ids []uint16
+	for n := uint8(2); n < 5; n++ {
+		entry := mainSdrAdd(testOemSdr(n))
+		if entry == nil {
+			t.Fatalf("record %d not added", n)
+		}
+		ids = append(ids, entry.recordId)
+	}
+	if ids[0] != 0xfffe || ids[1] != 2 || ids[2] != 3 {
+		t.Errorf("record ids %#x", ids)
+	}
+}
+
+// The repository fills up by the records in it, not the ids used
+func TestSdrRepositoryFull(t *testing.T) {
+	mcTestReset(t)
+	mc.mainSdrs.maxSdrCount = 2
+	mc.mainSdrs.nextFreeEntryId = 5000
+
+	if mainSdrAdd(testOemSdr(1)) == nil ||
+		mainSdrAdd(testOemSdr(2)) == nil {
+		t.Fatal("records not added")
+	}
+	if mainSdrAdd(testOemSdr(3)) != nil {
+		t.Error("record added to a full repository")
+	}
+	entry, prev := sdrEntryFind(5000)
+	mc.mainSdrs.unlink(entry, prev)
+	if mainSdrAdd(testOemSdr(3)) == nil {
+		t.Error("record not added after a delete")
+	}
+}
+
+// A compact record for a local sensor doesn't have what the sensor
+// needs from its sdr
+func TestPartialAddCompactSdr(t *testing.T) {
+	mcTestReset(t)
+	sensorAdd(mc.bmcIpmb, 0, 5, 1, 1)
+
+	record, err := (&CompactSensorSdr{SdrSensor: SdrSensor{
+		OwnerId: mc.bmcIpmb, Number: 5}, SensorType: 1,
+		EventReadingType: 1, SdrId: sdrId("0compact")}).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var recordId uint16
+	mc.mainSdrs.reservation = 7
+	for offset := 0; offset < len(record); offset += 16 {
+		end, progress := offset+16, uint8(SDR_PARTIAL_IN_PROGRESS)
+		if end >= len(record) {
+			end, progress = len(record), SDR_PARTIAL_LAST
+		}
+		req := []uint8{7, 0, uint8(recordId), uint8(recordId >> 8),
+			uint8(offset), progress}
+		req = append(req, record[offset:end]...)
+		rsp := testMsgRun(t, testMsgBuild(STORAGE_NETFN,
+			PARTIAL_ADD_SDR_CMD, req), partialAddSdr)
+		if rsp[0] != 0 {
+			t.Fatalf("offset %d: completion code %#x", offset, rsp[0])
+		}
+		recordId = binary.LittleEndian.Uint16(rsp[1:3])
+	}
+
+	if mc.mainSdrs.sdrCount != 1 || sdrFind(0, 5) == nil {
+		t.Fatalf("record not added")
+	}
+	if mc.sensors[0][5].sdr != nil {
+		t.Error("local sensor tied to a compact record")
+	}
+}
+
+// The erase is reported in progress until the main loop has done it
+func TestClearSdrRepository(t *testing.T) {
+	mcTestReset(t)
+	mainSdrAdd(testOemSdr(1))
+	mc.mainSdrs.reservation = 7
+
+	for _, c := range []struct {
+		op     uint8
+		run    bool
+		status uint8
+		count  uint16
+	}{
+		{0xaa, false, SDR_ERASE_IN_PROGRESS, 1},
+		{0, false, SDR_ERASE_IN_PROGRESS, 1},
+		{0, true, SDR_ERASE_COMPLETED, 0},
+		{0, false, SDR_ERASE_COMPLETED, 0},
+	} {
+		if c.run {
+			<-sdrErases
+			sdrsEraseRun()
+		}
+		rsp := testMsgRun(t, testMsgBuild(STORAGE_NETFN,
+			CLEAR_SDR_REPOSITORY_CMD,
+			[]uint8{7, 0, 'C', 'L', 'R', c.op}), clearSdrRepository)
+		if rsp[0] != 0 || rsp[1] != c.status {
+			t.Errorf("op %#x: response % x", c.op, rsp)
+		}
+		if mc.mainSdrs.sdrCount != c.count {
+			t.Errorf("op %#x: %d records", c.op,
+				mc.mainSdrs.sdrCount)
+		}
+	}
+	if mc.mainSdrs.sdrs != nil || mc.mainSdrs.reservation == 7 {
+		t.Error("repository not erased")
+	}
+}
+
+// Re-adding a record with new contents counts as an add, re-adding it
+// unchanged doesn't
+func TestAddSdrRefresh(t *testing.T) {
+	mcTestReset(t)
+	locator := &McLocatorSdr{SlaveAddr: 0x22, Capabilities: 0x01,
+		SdrLocator: SdrLocator{SdrId: sdrId("1mc")}}
+	entry := mainSdrAdd(locator)
+
+	for _, c := range []struct {
+		caps    uint8
+		changed bool
+	}{
+		{0x01, false},
+		{0xbf, true},
+	} {
+		mc.mainSdrs.reservation = 7
+		mc.mainSdrs.lastAddTime = 0
+		mc.mainSdrs.dirty = false
+		locator.Capabilities = c.caps
+		record, _ := locator.MarshalBinary()
+		rsp := testMsgRun(t, testMsgBuild(STORAGE_NETFN, ADD_SDR_CMD,
+			record), addSdr)
+		if rsp[0] != 0 ||
+			binary.LittleEndian.Uint16(rsp[1:3]) != entry.recordId {
+			t.Fatalf("caps %#x: response % x", c.caps, rsp)
+		}
+		if mc.mainSdrs.sdrCount != 1 || entry.data[8] != c.caps {
+			t.Errorf("caps %#x: not refreshed", c.caps)
+		}
+		changed := mc.mainSdrs.reservation != 7
+		if changed != c.changed || mc.mainSdrs.dirty != c.changed ||
+			(mc.mainSdrs.lastAddTime != 0) != c.changed {
+			t.Errorf("caps %#x: reservation %d add time %d", c.caps,
+				mc.mainSdrs.reservation, mc.mainSdrs.lastAddTime)
+		}
+	}
+}
+
+// Only an LC's own sensor records, sent from the chassis network, make
+// a card present
+func TestAddSdrCardSeen(t *testing.T) {
+	defer func(n string) { ChassisNet = n }(ChassisNet)
+
+	for _, c := range []struct {
+		name    string
+		net     string
+		owner   uint8
+		present bool
+	}{
+		{"lc", "127.0.0.0/8", cardIpmbAddr(3), true},
+		{"outside", "10.0.0.0/24", cardIpmbAddr(3), false},
+		{"other owner", "127.0.0.0/8", 0x20, false},
+	} {
+		mcTestReset(t)
+		ChassisNet = c.net
+		record, err := (&CompactSensorSdr{SdrSensor: SdrSensor{
+			OwnerId: c.owner, Number: 5, EntityId: 7,
+			EntityInstance: 3}, SensorType: 1,
+			EventReadingType: 1,
+			SdrId:            sdrId("3temp")}).MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		rsp := testMsgRun(t, testMsgBuild(STORAGE_NETFN, ADD_SDR_CMD,
+			record), addSdr)
+		if rsp[0] != 0 {
+			t.Fatalf("%s: completion code %#x", c.name, rsp[0])
+		}
+		_, seen := mc.cardLastSeen[3]
+		present := false
+		for _, sensor := range mc.sensorList {
+			if src, ok := sensor.source.(*cardPresenceSourceT); ok &&
+				src.card == 3 {
+				present = true
+			}
+		}
+		if seen != c.present || present != c.present {
+			t.Errorf("%s: seen %v, presence sensor %v", c.name,
+				seen, present)
+		}
+	}
+}
+
+// Commands changing the repository need the current reservation
+func TestSdrReservation(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		handler func(*msgT)
+		cmd     uint8
+		req     []uint8
+	}{
+		{"delete", deleteSdr, DELETE_SDR_CMD, []uint8{1, 0}},
+		{"partial add", partialAddSdr, PARTIAL_ADD_SDR_CMD,
+			[]uint8{0, 0, 0, SDR_PARTIAL_IN_PROGRESS, 1, 0}},
+		{"clear", clearSdrRepository, CLEAR_SDR_REPOSITORY_CMD,
+			[]uint8{'C', 'L', 'R', 0}},
+	} {
+		for _, r := range []struct {
+			reservation uint16
+			cc          uint8
+		}{
+			{0, IPMI_INVALID_RESERVATION_CC},
+			{6, IPMI_INVALID_RESERVATION_CC},
+			{7, 0},
+		} {
+			mcTestReset(t)
+			mainSdrAdd(testOemSdr(1))
+			mc.mainSdrs.reservation = 7
+			req := append([]uint8{uint8(r.reservation),
+				uint8(r.reservation >> 8)}, c.req...)
+			rsp := testMsgRun(t, testMsgBuild(STORAGE_NETFN, c.cmd,
+				req), c.handler)
+			if rsp[0] != r.cc {
+				t.Errorf("%s with reservation %d: completion "+
+					"code %#x", c.name, r.reservation, rsp[0])
+			}
+		}
+	}
+}
+
+// A full record added for one of our sensors configures it, as if
+// added by partial adds
+func TestAddSdrTie(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		owner uint8
+		tied  bool
+	}{
+		{"local", cardIpmbAddr(0), true},
+		{"other controller", cardIpmbAddr(2), false},
+	} {
+		mcTestReset(t)
+		sensorAdd(mc.bmcIpmb, 0, 5, 1, THRESHOLD_EVENT_TYPE)
+		full := &FullSensorSdr{SdrSensor: SdrSensor{OwnerId: c.owner,
+			Number: 5}, SensorType: 1,
+			EventReadingType: THRESHOLD_EVENT_TYPE,
+			SdrId:            sdrId("0added")}
+		full.Thresholds[THRESHOLD_UNC] = 80
+		record, err := full.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		rsp := testMsgRun(t, testMsgBuild(STORAGE_NETFN, ADD_SDR_CMD,
+			record), addSdr)
+		if rsp[0] != 0 {
+			t.Fatalf("%s: completion code %#x", c.name, rsp[0])
+		}
+		sensor := mc.sensors[0][5]
+		tied := sensor.sdr != nil
+		if tied != c.tied ||
+			(tied && sensor.thresholds[THRESHOLD_UNC] != 80) {
+			t.Errorf("%s: tied %v thresholds % x", c.name, tied,
+				sensor.thresholds)
+		}
+	}
+}
+
+// Records can't be read in update mode, whatever the request
+func TestSdrRepositoryUpdateMode(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		update bool
+		req    []uint8
+		cc     uint8
+	}{
+		{"read", false, []uint8{0, 0, 0, 0, 0, 0xff}, 0},
+		{"short", false, []uint8{0, 0, 0, 0, 0},
+			IPMI_REQUEST_DATA_LENGTH_INVALID_CC},
+		{"in update mode", true, []uint8{0, 0, 0, 0, 0, 0xff},
+			IPMI_REPOSITORY_IN_UPDATE_MODE_CC},
+		{"short in update mode", true, []uint8{0},
+			IPMI_REPOSITORY_IN_UPDATE_MODE_CC},
+	} {
+		mcTestReset(t)
+		mainSdrAdd(testOemSdr(1))
+		testMsgRun(t, testMsgBuild(STORAGE_NETFN,
+			ENTER_SDR_REPOSITORY_UPDATE_CMD, nil),
+			enterSdrRepositoryUpdate)
+		if !c.update {
+			testMsgRun(t, testMsgBuild(STORAGE_NETFN,
+				EXIT_SDR_REPOSITORY_UPDATE_CMD, nil),
+				exitSdrRepositoryUpdate)
+		}
+
+		rsp := testMsgRun(t, testMsgBuild(STORAGE_NETFN, GET_SDR_CMD,
+			c.req), getSdr)
+		if rsp[0] != c.cc {
+			t.Errorf("%s: completion code %#x", c.name, rsp[0])
+		}
+	}
+}
+
+// The repository clock keeps its offset from the set time across a
+// restart
+func TestSdrRepositoryTime(t *testing.T) {
+	now := uint32(time.Now().Unix())
+	for _, c := range []struct {
+		name string
+		req  []uint8
+		cc   uint8
+		want uint32
+	}{
+		{"short", []uint8{0, 0, 0}, IPMI_REQUEST_DATA_LENGTH_INVALID_CC,
+			now},
+		{"past", []uint8{0, 0, 0, 0x50}, 0, 0x50000000},
+		{"future", []uint8{0, 0, 0, 0xf0}, 0, 0xf0000000},
+	} {
+		mcTestReset(t)
+		rsp := testMsgRun(t, testMsgBuild(STORAGE_NETFN,
+			SET_SDR_REPOSITORY_TIME_CMD, c.req), setSdrRepositoryTime)
+		if rsp[0] != c.cc {
+			t.Errorf("%s: completion code %#x", c.name, rsp[0])
+			continue
+		}
+		if c.cc == 0 {
+			testSdrsReload(t)
+		}
+
+		rsp = testMsgRun(t, testMsgBuild(STORAGE_NETFN,
+			GET_SDR_REPOSITORY_TIME_CMD, nil), getSdrRepositoryTime)
+		got := binary.LittleEndian.Uint32(rsp[1:])
+		if len(rsp) != 5 || rsp[0] != 0 ||
+			got-c.want > 2 && c.want-got > 2 {
+			t.Errorf("%s: time %#x, want %#x", c.name, got, c.want)
+		}
+	}
+}
+
+// Free space is counted in whole allocation units per record
+func TestGetSdrRepositoryAllocInfo(t *testing.T) {
+	full := &FullSensorSdr{SdrSensor: SdrSensor{OwnerId: 0x20,
+		Number: 1}, SensorType: 1,
+		EventReadingType: THRESHOLD_EVENT_TYPE, SdrId: sdrId("temp")}
+
+	for _, c := range []struct {
+		name    string
+		records []Sdr
+		used    uint16
+	}{
+		{"empty", nil, 0},
+		{"compact", []Sdr{testOemSdr(1), testOemSdr(2)}, 2},
+		{"full", []Sdr{full}, 4},
+	} {
+		mcTestReset(t)
+		for _, record := range c.records {
+			mainSdrAdd(record)
+		}
+
+		rsp := testMsgRun(t, testMsgBuild(STORAGE_NETFN,
+			GET_SDR_REPOSITORY_ALLOC_INFO_CMD, nil),
+			getSdrRepositoryAllocInfo)
+		free := uint16(SDR_ALLOC_UNITS) - c.used
+		if len(rsp) != 10 || rsp[0] != 0 ||
+			binary.LittleEndian.Uint16(rsp[1:]) != SDR_ALLOC_UNITS ||
+			binary.LittleEndian.Uint16(rsp[3:]) !=
+				SDR_ALLOC_UNIT_SIZE ||
+			binary.LittleEndian.Uint16(rsp[5:]) != free ||
+			binary.LittleEndian.Uint16(rsp[7:]) != free ||
+			uint16(rsp[9])*SDR_ALLOC_UNIT_SIZE < MAX_SDR_LENGTH {
+			t.Errorf("%s: response % x", c.name, rsp)
+		}
+	}
+}
+
+// The agent puts back what set commands changed, but only when asked
+// to run
+func TestRunInitializationAgent(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		req      []uint8
+		cc       uint8
+		restored bool
+	}{
+		{"no request", nil, IPMI_REQUEST_DATA_LENGTH_INVALID_CC, false},
+		{"status", []uint8{0}, 0, false},
+		{"run", []uint8{1}, 0, true},
+	} {
+		mcTestReset(t)
+		root := t.TempDir()
+		testTreeWrite(t, root, testHwmonTree)
+		hwmonSensorsAdd(root)
+		sensor := mc.sensors[0][1]
+		sensor.sensorType = 0xc0
+		sensor.positiveHysteresis = sensor.sdr.data[42] + 1
+		sensor.thresholds[0] = sensor.sdr.data[41] + 1
+		sensor.eventEnabled = [2]uint16{}
+		sensor.eventsEnabled = false
+
+		rsp := testMsgRun(t, testMsgBuild(STORAGE_NETFN,
+			RUN_INITIALIZATION_AGENT_CMD, c.req),
+			runInitializationAgent)
+		if rsp[0] != c.cc {
+			t.Errorf("%s: completion code %#x", c.name, rsp[0])
+			continue
+		}
+		if c.cc == 0 && (len(rsp) != 2 || rsp[1] != 1) {
+			t.Errorf("%s: response % x", c.name, rsp)
+		}
+		restored := sensor.sensorType == sensor.sdr.data[12] &&
+			sensor.positiveHysteresis == sensor.sdr.data[42] &&
+			sensor.thresholds[0] == sensor.sdr.data[41] &&
+			sensor.eventEnabled == sensor.eventSupported &&
+			sensor.eventsEnabled
+		if restored != c.restored {
+			t.Errorf("%s: restored %v", c.name, restored)
+		}
+	}
+}
+
+// A saved OEM record with the given record id
+func testSavedSdr(t *testing.T, recordId uint16, n uint8) []uint8 {
+	record, err := testOemSdr(n).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	binary.LittleEndian.PutUint16(record[0:2], recordId)
+	return record
+}
+
+// A saved repository comes back with its record ids, skipping records
+// it can't use, and one of another version isn't loaded at all
+func TestSdrsLoad(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		version int
+		records [][]uint8
+		ids     []uint16
+		next    uint16
+	}{
+		{"ids kept", SDR_STATE_VERSION, [][]uint8{
+			testSavedSdr(t, 1, 1), testSavedSdr(t, 7, 2)},
+			[]uint16{1, 7}, 8},
+		{"other version", SDR_STATE_VERSION + 1, [][]uint8{
+			testSavedSdr(t, 1, 1)}, nil, 1},
+		{"bad record", SDR_STATE_VERSION, [][]uint8{
+			testSavedSdr(t, 1, 1)[:4], testSavedSdr(t, 2, 2)},
+			[]uint16{2}, 3},
+		{"reserved ids", SDR_STATE_VERSION, [][]uint8{
+			testSavedSdr(t, 0, 1), testSavedSdr(t, 0xffff, 2),
+			testSavedSdr(t, 3, 3)}, []uint16{3}, 4},
+		{"duplicate id", SDR_STATE_VERSION, [][]uint8{
+			testSavedSdr(t, 5, 1), testSavedSdr(t, 5, 2)},
+			[]uint16{5}, 6},
+	} {
+		mcTestReset(t)
+		err := stateSave(SDR_STATE_FILE, &sdrsSavedT{
+			Version:         c.version,
+			NextFreeEntryId: 1,
+			LastAddTime:     0x1234,
+			Records:         c.records,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sdrsLoad()
+
+		var ids []uint16
+		for entry := mc.mainSdrs.sdrs; entry != nil; entry = entry.next {
+			ids = append(ids, entry.recordId)
+		}
+		if len(ids) != len(c.ids) {
+			t.Errorf("%s: record ids %v", c.name, ids)
+			continue
+		}
+		for i := range ids {
+			if ids[i] != c.ids[i] {
+				t.Errorf("%s: record ids %v", c.name, ids)
+				break
+			}
+		}
+		if mc.mainSdrs.nextFreeEntryId != c.next ||
+			mc.mainSdrs.sdrCount != uint16(len(c.ids)) {
+			t.Errorf("%s: next id %d, count %d", c.name,
+				mc.mainSdrs.nextFreeEntryId, mc.mainSdrs.sdrCount)
+		}
+		if c.ids != nil && mc.mainSdrs.lastAddTime != 0x1234 {
+			t.Errorf("%s: last add time %#x", c.name,
+				mc.mainSdrs.lastAddTime)
+		}
+	}
+}
+
+// Records saved by the main loop come back whole after a restart, and
+// a restart without a saved repository starts empty
+func TestSdrsSaveLoad(t *testing.T) {
+	mcTestReset(t)
+	sdrsLoad()
+	if mc.mainSdrs.sdrs != nil || mc.mainSdrs.nextFreeEntryId != 1 {
+		t.Fatal("records loaded without a saved repository")
+	}
+
+	for n := uint8(1); n <= 3; n++ {
+		mainSdrAdd(testOemSdr(n))
+	}
+	entry, prev := sdrEntryFind(2)
+	mc.mainSdrs.unlink(entry, prev)
+	var want [][]uint8
+	for entry := mc.mainSdrs.sdrs; entry != nil; entry = entry.next {
+		want = append(want, append([]uint8(nil),
+			entry.data[:entry.length]...))
+	}
+
+	testSdrsReload(t)
+	i := 0
+	for entry := mc.mainSdrs.sdrs; entry != nil; entry = entry.next {
+		if i >= len(want) ||
+			!bytes.Equal(entry.data[:entry.length], want[i]) {
+			t.Errorf("record %d: % x", i, entry.data[:entry.length])
+		}
+		i++
+	}
+	if i != len(want) {
+		t.Errorf("%d records loaded, want %d", i, len(want))
+	}
+	if entry := mainSdrAdd(testOemSdr(4)); entry == nil ||
+		entry.recordId != 4 {
+		t.Error("record id reused after a restart")
+	}
+}
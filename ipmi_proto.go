@@ -10,6 +10,7 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"time"
 )
 
 const (
@@ -164,10 +165,46 @@ func Ipmigod(mmCardMode bool, cardNum int) {
 		}
 	}(serverConn)
 
+	// The sdr repository is saved from here, where it's changed
+	sdrsSaveTicker := time.NewTicker(SDR_SAVE_INTERVAL)
+	defer sdrsSaveTicker.Stop()
+
+	// Each sensor is read when its own poll interval comes due
+	sensorTicker := time.NewTicker(SENSOR_POLL_TICK)
+	defer sensorTicker.Stop()
+
+	pohTicker := time.NewTicker(POH_TICK)
+	defer pohTicker.Stop()
+
+	// Bridged requests are retried and timed out from here
+	bridgeTicker := time.NewTicker(BRIDGE_TICK)
+	defer bridgeTicker.Stop()
+
 	for {
 		select {
 		case msg := <-udpMessages:
 			msg.ipmiHandleMsg()
+		case <-sdrsSaveTicker.C:
+			sdrsSaveRun()
+		case <-sdrErases:
+			sdrsEraseRun()
+		case t := <-sensorTicker.C:
+			if debug {
+				fmt.Println("Tick at", t)
+			}
+			pollSensors()
+		case r := <-sensorReadings:
+			sensorReadDone(r)
+		case r := <-bridgeResponses:
+			bridgeRspDone(r)
+		case <-bridgeTicker.C:
+			bridgeExpire()
+		case <-pohTicker.C:
+			chassisPohTick()
+		case <-timerChan(mc.chassis.identifyTimer):
+			chassisIdentifyExpired()
+		case <-timerChan(bootFlagsTimer):
+			bootFlagsExpired()
 		default:
 			if Signaled() {
 				fmt.Println("Got kill signal - returning")
@@ -177,6 +214,15 @@ func Ipmigod(mmCardMode bool, cardNum int) {
 	}
 }
 
+// The channel of a timer the main loop waits on, nil (never ready)
+// when the timer isn't running
+func timerChan(t *time.Timer) <-chan time.Time {
+	if t == nil {
+		return nil
+	}
+	return t.C
+}
+
 func (msg *msgT) ipmiHandleMsg() {
 
 	if msg.dataLen < 5 {
@@ -269,6 +315,15 @@ func (msg *msgT) ipmiParseRmcpMsg() {
 	msg.dataStart += 6
 }
 
+// Length of the request data between the command and the trailing
+// message checksum.
+func (msg *msgT) reqDataLen() uint {
+	if msg.dataLen <= msg.dataStart {
+		return 0
+	}
+	return msg.dataLen - msg.dataStart - 1
+}
+
 func (msg *msgT) returnRsp(session *sessionT, rsp *rspMsgDataT) {
 	var (
 		data         [MAX_MSG_RETURN_DATA]uint8
@@ -406,6 +461,7 @@ type chassisProcessor func(*msgT)
 
 var chassisProcessors = map[uint8]chassisProcessor{
 	GET_CHASSIS_CAPABILITIES_CMD: getChassisCapabilities,
+	GET_CHASSIS_STATUS_CMD:       getChassisStatus,
 	CHASSIS_CONTROL_CMD:          chassisControl,
 	CHASSIS_RESET_CMD:            chassisReset,
 	CHASSIS_IDENTIFY_CMD:         chassisIdentify,
@@ -414,6 +470,8 @@ var chassisProcessors = map[uint8]chassisProcessor{
 	GET_SYSTEM_RESTART_CAUSE_CMD: getSystemRestartCause,
 	SET_SYSTEM_BOOT_OPTIONS_CMD:  setSystemBootOptions,
 	GET_SYSTEM_BOOT_OPTIONS_CMD:  getSystemBootOptions,
+
+	GET_POH_COUNTER_CMD: getPohCounter,
 }
 
 func chassisNetfn(msg *msgT) {
@@ -640,9 +698,27 @@ func groupExtensionNetfn(msg *msgT) {
 		msg.rmcp.message.cmd)
 }
 
+type oemProcessor func(*msgT)
+
+var oemProcessors = map[uint8]oemProcessor{
+	OEM_GET_SENSOR_HISTORY_CMD: oemGetSensorHistory,
+}
+
+// OEM/Group requests and responses lead with the IANA number, ours is
+// the manufacturer id from get device id.
 func oemGroupNetfn(msg *msgT) {
-	fmt.Println("oemGroupNetfn not supported",
-		msg.rmcp.message.cmd)
+	dataStart := msg.dataStart
+	processor := oemProcessors[msg.rmcp.message.cmd]
+	if processor == nil || msg.reqDataLen() < 3 ||
+		msg.data[dataStart] != mc.mfgId[0] ||
+		msg.data[dataStart+1] != mc.mfgId[1] ||
+		msg.data[dataStart+2] != mc.mfgId[2] {
+		fmt.Println("oemGroupNetfn not supported",
+			msg.rmcp.message.cmd)
+		msg.returnErr(nil, IPMI_INVALID_CMD_CC)
+		return
+	}
+	processor(msg)
 }
 
 const ASF_IANA = 4542
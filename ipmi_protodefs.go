@@ -25,6 +25,7 @@ const (
 
 	// Chassis netfn (0x00)
 	GET_CHASSIS_CAPABILITIES_CMD = 0x00
+	GET_CHASSIS_STATUS_CMD       = 0x01
 	CHASSIS_CONTROL_CMD          = 0x02
 	CHASSIS_RESET_CMD            = 0x03
 	CHASSIS_IDENTIFY_CMD         = 0x04
@@ -208,6 +209,9 @@ const (
 	SOL_ACTIVATING_CMD               = 0x20
 	SET_SOL_CONFIGURATION_PARAMETERS = 0x21
 	GET_SOL_CONFIGURATION_PARAMETERS = 0x22
+
+	// OEM/Group netfn (0x2e), requests start with our IANA number
+	OEM_GET_SENSOR_HISTORY_CMD = 0x01
 )
 
 //
@@ -249,6 +253,14 @@ const (
 	IPMI_AUTHTYPE_RMCP_PLUS = 6
 )
 
+// IPMI channel numbers
+const (
+	IPMI_CHANNEL_IPMB    = 0x0
+	IPMI_CHANNEL_LAN     = 0x1
+	IPMI_CHANNEL_CURRENT = 0xe
+	IPMI_MAX_CHANNELS    = 16
+)
+
 // IPMI privilege levels
 const (
 	IPMI_PRIVILEGE_CALLBACK = 1
@@ -0,0 +1,63 @@
+// Copyright 2015 Platina Systems, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style license described in the
+// LICENSE file.
+
+// Package contains IPMI 2.0 spec implementation
+package ipmigod
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+)
+
+// Directory holding state that must survive ipmigod restarts
+var stateDir string = "/var/lib/ipmigod"
+
+// Atomically replace state file name with data
+func stateWrite(name string, data []byte) error {
+	err := os.MkdirAll(stateDir, 0755)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(stateDir, name+".tmp")
+	if err != nil {
+		return err
+	}
+	tmpName := f.Name()
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmpName, filepath.Join(stateDir, name))
+	}
+	if err != nil {
+		os.Remove(tmpName)
+	}
+	return err
+}
+
+func stateRead(name string) ([]byte, error) {
+	return os.ReadFile(filepath.Join(stateDir, name))
+}
+
+func stateSave(name string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "\t")
+	if err != nil {
+		return err
+	}
+	return stateWrite(name, data)
+}
+
+func stateLoad(name string, v interface{}) error {
+	data, err := stateRead(name)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
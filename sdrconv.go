@@ -0,0 +1,294 @@
+// Copyright 2015 Platina Systems, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style license described in the
+// LICENSE file.
+
+// Package contains IPMI 2.0 spec implementation
+package ipmigod
+
+import (
+	"math"
+)
+
+// Analog data formats (full sdr units 1 bits 7:6)
+const (
+	SDR_FORMAT_UNSIGNED = 0
+	SDR_FORMAT_1S_COMPL = 1
+	SDR_FORMAT_2S_COMPL = 2
+	SDR_FORMAT_NUMERIC  = 3
+)
+
+// Linearization functions (full sdr byte 24)
+const (
+	SDR_LINEAR = iota
+	SDR_LINEAR_LN
+	SDR_LINEAR_LOG10
+	SDR_LINEAR_LOG2
+	SDR_LINEAR_E
+	SDR_LINEAR_EXP10
+	SDR_LINEAR_EXP2
+	SDR_LINEAR_1_X
+	SDR_LINEAR_SQR
+	SDR_LINEAR_CUBE
+	SDR_LINEAR_SQRT
+	SDR_LINEAR_CUBE_ROOT
+	SDR_NON_LINEAR = 0x70
+)
+
+// Reading conversion factors of a full sensor sdr
+type sdrFactorsT struct {
+	m      int
+	b      int
+	bExp   int
+	rExp   int
+	format uint8
+	linear uint8
+}
+
+// Sign extend the low bits of v
+func signExtend(v int, bits uint) int {
+	shift := 32 - bits
+	return int(int32(v<<shift) >> shift)
+}
+
+func sdrFactors(data []uint8) sdrFactorsT {
+	var f sdrFactorsT
+
+	f.format = data[20] >> 6
+	f.linear = data[23] & 0x7f
+	f.m = signExtend(int(data[24])|int(data[25]&0xc0)<<2, 10)
+	f.b = signExtend(int(data[26])|int(data[27]&0xc0)<<2, 10)
+	f.rExp = signExtend(int(data[29]>>4), 4)
+	f.bExp = signExtend(int(data[29]&0xf), 4)
+	return f
+}
+
+// Raw reading byte as a signed value per the analog data format
+func (f sdrFactorsT) rawToInt(raw uint8) int {
+	switch f.format {
+	case SDR_FORMAT_1S_COMPL:
+		if raw&0x80 != 0 {
+			return -int(^raw)
+		}
+	case SDR_FORMAT_2S_COMPL:
+		return int(int8(raw))
+	}
+	return int(raw)
+}
+
+func (f sdrFactorsT) intToRaw(v int) uint8 {
+	switch f.format {
+	case SDR_FORMAT_1S_COMPL:
+		if v < -127 {
+			v = -127
+		} else if v > 127 {
+			v = 127
+		}
+		if v < 0 {
+			return ^uint8(-v)
+		}
+	case SDR_FORMAT_2S_COMPL:
+		if v < -128 {
+			v = -128
+		} else if v > 127 {
+			v = 127
+		}
+		return uint8(int8(v))
+	default:
+		if v < 0 {
+			v = 0
+		} else if v > 255 {
+			v = 255
+		}
+	}
+	return uint8(v)
+}
+
+func linearize(linear uint8, y float64) float64 {
+	switch linear {
+	case SDR_LINEAR_LN:
+		return math.Log(y)
+	case SDR_LINEAR_LOG10:
+		return math.Log10(y)
+	case SDR_LINEAR_LOG2:
+		return math.Log2(y)
+	case SDR_LINEAR_E:
+		return math.Exp(y)
+	case SDR_LINEAR_EXP10:
+		return math.Pow(10, y)
+	case SDR_LINEAR_EXP2:
+		return math.Exp2(y)
+	case SDR_LINEAR_1_X:
+		return 1 / y
+	case SDR_LINEAR_SQR:
+		return y * y
+	case SDR_LINEAR_CUBE:
+		return y * y * y
+	case SDR_LINEAR_SQRT:
+		return math.Sqrt(y)
+	case SDR_LINEAR_CUBE_ROOT:
+		return math.Cbrt(y)
+	}
+	return y
+}
+
+func unlinearize(linear uint8, y float64) float64 {
+	switch linear {
+	case SDR_LINEAR_LN:
+		return math.Exp(y)
+	case SDR_LINEAR_LOG10:
+		return math.Pow(10, y)
+	case SDR_LINEAR_LOG2:
+		return math.Exp2(y)
+	case SDR_LINEAR_E:
+		return math.Log(y)
+	case SDR_LINEAR_EXP10:
+		return math.Log10(y)
+	case SDR_LINEAR_EXP2:
+		return math.Log2(y)
+	case SDR_LINEAR_1_X:
+		return 1 / y
+	case SDR_LINEAR_SQR:
+		return math.Sqrt(y)
+	case SDR_LINEAR_CUBE:
+		return math.Cbrt(y)
+	case SDR_LINEAR_SQRT:
+		return y * y
+	case SDR_LINEAR_CUBE_ROOT:
+		return y * y * y
+	}
+	return y
+}
+
+// y = L[(M*x + B*10^Bexp) * 10^Rexp]
+func (f sdrFactorsT) toReal(raw uint8) float64 {
+	x := float64(f.rawToInt(raw))
+	y := (float64(f.m)*x + float64(f.b)*math.Pow10(f.bExp)) *
+		math.Pow10(f.rExp)
+	return linearize(f.linear, y)
+}
+
+// x = (L'[y] / 10^Rexp - B*10^Bexp) / M
+func (f sdrFactorsT) toRaw(value float64) uint8 {
+	if f.m == 0 {
+		return f.intToRaw(0)
+	}
+	y := unlinearize(f.linear, value)
+	x := (y/math.Pow10(f.rExp) - float64(f.b)*math.Pow10(f.bExp)) /
+		float64(f.m)
+	if math.IsNaN(x) {
+		x = 0
+	}
+	return f.intToRaw(int(math.Round(x)))
+}
+
+// Convert a real reading into the raw byte for a full sensor sdr
+func sdrRawFromReal(sdr *sdrT, value float64) uint8 {
+	return sdrFactors(sdr.data[:]).toRaw(value)
+}
+
+// Convert a raw reading byte into a real value for a full sensor sdr
+func sdrRealFromRaw(sdr *sdrT, raw uint8) float64 {
+	return sdrFactors(sdr.data[:]).toReal(raw)
+}
+
+// Non-linear sensors (linearization 0x70-0x7f) have no fixed factors
+// in their sdr, they come from get sensor reading factors instead.
+func sdrNonLinear(sdr *sdrT) bool {
+	return sdr.data[23]&0x7f >= SDR_NON_LINEAR
+}
+
+// Raw readings from start up to the next range's start share factors
+type sdrFactorsRangeT struct {
+	start   uint8
+	factors sdrFactorsT
+}
+
+// Per reading conversion factors of a non-linear sensor, ranges sorted
+// by their first raw reading.
+type sdrFactorsTableT []sdrFactorsRangeT
+
+// Factors that apply to a raw reading and the next raw reading that
+// uses different ones.
+func (t sdrFactorsTableT) lookup(raw uint8) (sdrFactorsT, uint8) {
+	var (
+		f    sdrFactorsT
+		next uint8 = 0xff
+	)
+
+	for i := range t {
+		if t[i].start > raw {
+			next = t[i].start
+			break
+		}
+		f = t[i].factors
+	}
+	return f, next
+}
+
+// Raw reading whose conversion comes closest to the real value
+func (t sdrFactorsTableT) toRaw(sdr *sdrT, value float64) uint8 {
+	var best uint8
+
+	format := sdr.data[20] >> 6
+	bestDiff := math.Inf(1)
+	for raw := 0; raw < 256; raw++ {
+		f, _ := t.lookup(uint8(raw))
+		f.format = format
+		f.linear = SDR_LINEAR
+		diff := math.Abs(f.toReal(uint8(raw)) - value)
+		if diff < bestDiff {
+			best, bestDiff = uint8(raw), diff
+		}
+	}
+	return best
+}
+
+// Conversion factors giving the finest resolution that still spans
+// [min, max] with an unsigned raw reading of 0 to 255.
+func sdrFactorsForRange(min float64, max float64) sdrFactorsT {
+	var f sdrFactorsT
+
+	f.format = SDR_FORMAT_UNSIGNED
+	f.linear = SDR_LINEAR
+	res := (max - min) / 255
+	if res <= 0 {
+		res = 1
+	}
+
+	// Smallest result exponent that keeps M within 10 bits
+	for f.rExp = -8; f.rExp < 7; f.rExp++ {
+		if math.Ceil(res/math.Pow10(f.rExp)) <= 511 {
+			break
+		}
+	}
+	f.m = int(math.Ceil(res / math.Pow10(f.rExp)))
+
+	// Offset is rounded down so min never reads below raw 0
+	offset := min / math.Pow10(f.rExp)
+	for f.bExp = -8; f.bExp < 7; f.bExp++ {
+		if math.Abs(offset/math.Pow10(f.bExp)) <= 511 {
+			break
+		}
+	}
+	f.b = int(math.Floor(offset / math.Pow10(f.bExp)))
+	if f.b < -512 {
+		f.b = -512
+	} else if f.b > 511 {
+		f.b = 511
+	}
+	return f
+}
+
+// Sdr bytes 25-30 (M, M/tolerance, B, B/accuracy, accuracy/direction,
+// R/B exponents) for the factors.
+func (f sdrFactorsT) bytes() [6]uint8 {
+	var data [6]uint8
+
+	data[0] = uint8(f.m)
+	data[1] = uint8((f.m>>8)&0x3) << 6
+	data[2] = uint8(f.b)
+	data[3] = uint8((f.b>>8)&0x3) << 6
+	data[4] = 0
+	data[5] = uint8(f.rExp&0xf)<<4 | uint8(f.bExp&0xf)
+	return data
+}
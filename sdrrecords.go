@@ -0,0 +1,99 @@
+// Copyright 2015 Platina Systems, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style license described in the
+// LICENSE file.
+
+// Package contains IPMI 2.0 spec implementation
+package ipmigod
+
+import (
+	"fmt"
+)
+
+// Sdr record types
+const (
+	SDR_FULL_SENSOR            = 0x01
+	SDR_COMPACT_SENSOR         = 0x02
+	SDR_EVENT_ONLY             = 0x03
+	SDR_ENTITY_ASSOCIATION     = 0x08
+	SDR_DEV_ENTITY_ASSOCIATION = 0x09
+	SDR_GENERIC_DEV_LOCATOR    = 0x10
+	SDR_FRU_DEV_LOCATOR        = 0x11
+	SDR_MC_DEV_LOCATOR         = 0x12
+	SDR_OEM                    = 0xc0
+)
+
+// Device type of a FRU device locator for FRU inventory behind a
+// management controller
+const SDR_FRU_DEV_TYPE_MC_FRU = 0x10
+
+func sdrRecordType(sdr *sdrT) uint8 {
+	return sdr.data[3]
+}
+
+// Full, compact and event-only records describe a sensor, with the
+// owner lun and sensor number at the same place.
+func sdrIsSensor(sdr *sdrT) bool {
+	switch sdrRecordType(sdr) {
+	case SDR_FULL_SENSOR, SDR_COMPACT_SENSOR, SDR_EVENT_ONLY:
+		return true
+	}
+	return false
+}
+
+// Set up the sensor lookup keys of an entry from its record. Records
+// that aren't for a sensor never match a sensor lookup.
+func sdrKeySet(sdr *sdrT) {
+	if sdrIsSensor(sdr) {
+		sdr.lun = sdr.data[6] & 0x3
+		sdr.sensNum = sdr.data[7]
+	} else {
+		sdr.lun = 0
+		sdr.sensNum = 0xff
+	}
+}
+
+// Offset of the id string type/length byte, or 0 if the record type
+// has no id string.
+func sdrIdOffset(sdr *sdrT) int {
+	switch sdrRecordType(sdr) {
+	case SDR_FULL_SENSOR:
+		return 47
+	case SDR_COMPACT_SENSOR:
+		return 31
+	case SDR_EVENT_ONLY:
+		return 16
+	case SDR_GENERIC_DEV_LOCATOR, SDR_FRU_DEV_LOCATOR,
+		SDR_MC_DEV_LOCATOR:
+		return 15
+	}
+	return 0
+}
+
+// Management controller device locator for this bmc
+func mcLocatorSdrAdd() {
+	mainSdrAdd(&McLocatorSdr{
+		SlaveAddr: mc.bmcIpmb,
+		Channel:   IPMI_CHANNEL_IPMB,
+		// acpi/global init 0: enable event msg generation
+		Capabilities: mc.deviceSupport,
+		SdrLocator: SdrLocator{
+			Entity: SdrEntity{ENTITY_SYSTEM_BOARD, chassisCardNum},
+			SdrId:  sdrId(fmt.Sprintf("%dBMC", chassisCardNum)),
+		},
+	})
+}
+
+// Locator for the logical FRU device 0 on this bmc
+func fruLocatorSdrAdd() {
+	mainSdrAdd(&FruLocatorSdr{
+		AccessAddr:   mc.bmcIpmb,
+		FruId:        0,
+		AccessLunBus: 0x80, // logical FRU device, lun 0, private bus 0
+		Channel:      IPMI_CHANNEL_IPMB << 4,
+		DeviceType:   SDR_FRU_DEV_TYPE_MC_FRU,
+		SdrLocator: SdrLocator{
+			Entity: SdrEntity{ENTITY_SYSTEM_BOARD, chassisCardNum},
+			SdrId:  sdrId(fmt.Sprintf("%dFRU", chassisCardNum)),
+		},
+	})
+}
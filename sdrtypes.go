@@ -0,0 +1,802 @@
+// Copyright 2015 Platina Systems, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style license described in the
+// LICENSE file.
+
+// Package contains IPMI 2.0 spec implementation
+package ipmigod
+
+import (
+	"encoding"
+	"errors"
+	"strings"
+)
+
+// Id string type/length byte types (bits 7:6)
+const (
+	SDR_ID_UNICODE    = 0
+	SDR_ID_BCD_PLUS   = 1
+	SDR_ID_6BIT_ASCII = 2
+	SDR_ID_8BIT_ASCII = 3
+
+	// Longest id string, in encoded bytes
+	SDR_ID_MAX = 16
+)
+
+var (
+	errSdrLength = errors.New("sdr record length invalid")
+	errSdrType   = errors.New("sdr record type mismatch")
+	errSdrId     = errors.New("sdr id string invalid")
+)
+
+// An SDR record of any type, encoded to and decoded from the
+// repository format, header included.
+type Sdr interface {
+	encoding.BinaryMarshaler
+	encoding.BinaryUnmarshaler
+	Header() *SdrHeader
+}
+
+// Record id and version, the type and length come from the record
+type SdrHeader struct {
+	RecordId   uint16
+	Version    uint8
+	RecordType uint8
+}
+
+func (h *SdrHeader) Header() *SdrHeader {
+	return h
+}
+
+// Header bytes, length is filled in by sdrDone
+func (h *SdrHeader) bytes(recordType uint8) []uint8 {
+	h.RecordType = recordType
+	if h.Version == 0 {
+		h.Version = 0x51
+	}
+	data := make([]uint8, 5, 64)
+	data[0] = uint8(h.RecordId)
+	data[1] = uint8(h.RecordId >> 8)
+	data[2] = h.Version
+	data[3] = recordType
+	return data
+}
+
+// Check record length and type, returns the record up to its length
+func (h *SdrHeader) parse(data []uint8, recordType uint8,
+	minLen int) ([]uint8, error) {
+
+	if len(data) < 5 || len(data) < int(data[4])+5 {
+		return nil, errSdrLength
+	}
+	data = data[:int(data[4])+5]
+	if data[3] != recordType {
+		return nil, errSdrType
+	}
+	if len(data) < minLen {
+		return nil, errSdrLength
+	}
+	h.RecordId = uint16(data[0]) | uint16(data[1])<<8
+	h.Version = data[2]
+	h.RecordType = data[3]
+	return data, nil
+}
+
+// The record length byte covers what follows the 5 byte header
+func sdrDone(data []uint8) ([]uint8, error) {
+	if len(data)-5 > 0xff || len(data) > MAX_SDR_LENGTH {
+		return nil, errSdrLength
+	}
+	data[4] = uint8(len(data) - 5)
+	return data, nil
+}
+
+func sdrAppendUint16(data []uint8, v uint16) []uint8 {
+	return append(data, uint8(v), uint8(v>>8))
+}
+
+func sdrUint16(data []uint8) uint16 {
+	return uint16(data[0]) | uint16(data[1])<<8
+}
+
+// Id string of a record and how it's encoded
+type SdrId struct {
+	IdType uint8
+	Id     string
+}
+
+// An 8-bit ascii id, the usual kind
+func sdrId(id string) SdrId {
+	return SdrId{IdType: SDR_ID_8BIT_ASCII, Id: id}
+}
+
+func (s *SdrId) bytes(data []uint8) ([]uint8, error) {
+	id, err := SdrIdEncode(s.IdType, s.Id)
+	if err != nil {
+		return nil, err
+	}
+	return append(data, id...), nil
+}
+
+// Records may end before the id, that's an empty id
+func (s *SdrId) parse(data []uint8) error {
+	var err error
+
+	s.IdType, s.Id = SDR_ID_8BIT_ASCII, ""
+	if len(data) == 0 {
+		return nil
+	}
+	s.IdType, s.Id, err = SdrIdDecode(data)
+	return err
+}
+
+const bcdPlusChars = "0123456789 -.:,_"
+
+// Type/length byte and the encoded id. Longer ids are cut to fit
+// SDR_ID_MAX bytes; 6-bit ascii only has upper case.
+func SdrIdEncode(idType uint8, id string) ([]uint8, error) {
+	var data []uint8
+
+	switch idType {
+	case SDR_ID_UNICODE, SDR_ID_8BIT_ASCII:
+		data = []uint8(id)
+		if len(data) > SDR_ID_MAX {
+			data = data[:SDR_ID_MAX]
+		}
+	case SDR_ID_BCD_PLUS:
+		if len(id) > 2*SDR_ID_MAX {
+			id = id[:2*SDR_ID_MAX]
+		}
+		// Two characters per byte, first in the high nibble
+		for i := 0; i < len(id); i += 2 {
+			hi := strings.IndexByte(bcdPlusChars, id[i])
+			lo := strings.IndexByte(bcdPlusChars, ' ')
+			if i+1 < len(id) {
+				lo = strings.IndexByte(bcdPlusChars, id[i+1])
+			}
+			if hi < 0 || lo < 0 {
+				return nil, errSdrId
+			}
+			data = append(data, uint8(hi<<4|lo))
+		}
+	case SDR_ID_6BIT_ASCII:
+		id = strings.ToUpper(id)
+		if len(id) > SDR_ID_MAX*8/6 {
+			id = id[:SDR_ID_MAX*8/6]
+		}
+		// Four characters per three bytes, first in the low bits
+		var bits, n uint
+		for i := 0; i < len(id); i++ {
+			c := id[i]
+			if c < 0x20 || c > 0x5f {
+				return nil, errSdrId
+			}
+			bits |= uint(c-0x20) << n
+			for n += 6; n >= 8; n -= 8 {
+				data = append(data, uint8(bits))
+				bits >>= 8
+			}
+		}
+		if n > 0 {
+			data = append(data, uint8(bits))
+		}
+	default:
+		return nil, errSdrId
+	}
+	return append([]uint8{idType<<6 | uint8(len(data))}, data...), nil
+}
+
+// Decode an id from its type/length byte on
+func SdrIdDecode(data []uint8) (idType uint8, id string, err error) {
+	if len(data) == 0 {
+		return 0, "", errSdrLength
+	}
+	idType = data[0] >> 6
+	n := int(data[0] & 0x1f)
+	if n+1 > len(data) {
+		return idType, "", errSdrLength
+	}
+	data = data[1 : n+1]
+
+	switch idType {
+	case SDR_ID_BCD_PLUS:
+		out := make([]uint8, 0, 2*n)
+		for _, b := range data {
+			out = append(out, bcdPlusChars[b>>4],
+				bcdPlusChars[b&0xf])
+		}
+		id = strings.TrimRight(string(out), " ")
+	case SDR_ID_6BIT_ASCII:
+		var out []uint8
+		var bits, nbits uint
+		for _, b := range data {
+			bits |= uint(b) << nbits
+			for nbits += 8; nbits >= 6; nbits -= 6 {
+				out = append(out, uint8(bits&0x3f)+0x20)
+				bits >>= 6
+			}
+		}
+		id = strings.TrimRight(string(out), " ")
+	default:
+		id = string(data)
+	}
+	return idType, id, nil
+}
+
+// Owner, number and entity bytes every sensor record starts with
+type SdrSensor struct {
+	OwnerId        uint8
+	OwnerLun       uint8 // channel in bits 7:4, lun in 1:0
+	Number         uint8
+	EntityId       uint8
+	EntityInstance uint8
+}
+
+func (s *SdrSensor) sensorKey() *SdrSensor {
+	return s
+}
+
+func (s *SdrSensor) bytes(data []uint8) []uint8 {
+	return append(data, s.OwnerId, s.OwnerLun, s.Number, s.EntityId,
+		s.EntityInstance)
+}
+
+func (s *SdrSensor) parse(data []uint8) {
+	s.OwnerId = data[5]
+	s.OwnerLun = data[6]
+	s.Number = data[7]
+	s.EntityId = data[8]
+	s.EntityInstance = data[9]
+}
+
+// Implemented by the full, compact and event-only records
+type sensorSdr interface {
+	Sdr
+	sensorKey() *SdrSensor
+}
+
+// Type 01
+type FullSensorSdr struct {
+	SdrHeader
+	SdrSensor
+	Init             uint8
+	Caps             uint8
+	SensorType       uint8
+	EventReadingType uint8
+	AssertionMask    uint16
+	DeassertionMask  uint16
+	ReadingMask      uint16
+	Units1           uint8
+	Units2           uint8
+	Units3           uint8
+	Linearization    uint8
+	M                int16  // 10 bits
+	Tolerance        uint8  // 6 bits
+	B                int16  // 10 bits
+	Accuracy         uint16 // 10 bits
+	AccuracyExp      uint8
+	Direction        uint8
+	RExp             int8 // 4 bits
+	BExp             int8 // 4 bits
+	AnalogFlags      uint8
+	NominalReading   uint8
+	NormalMax        uint8
+	NormalMin        uint8
+	SensorMax        uint8
+	SensorMin        uint8
+	Thresholds       [NUM_THRESHOLDS]uint8 // by THRESHOLD_LNC..UNR
+	PosHysteresis    uint8
+	NegHysteresis    uint8
+	Oem              uint8
+	SdrId
+}
+
+func (s *FullSensorSdr) MarshalBinary() ([]byte, error) {
+	data := s.SdrHeader.bytes(SDR_FULL_SENSOR)
+	data = s.SdrSensor.bytes(data)
+	data = append(data, s.Init, s.Caps, s.SensorType, s.EventReadingType)
+	data = sdrAppendUint16(data, s.AssertionMask)
+	data = sdrAppendUint16(data, s.DeassertionMask)
+	data = sdrAppendUint16(data, s.ReadingMask)
+	data = append(data, s.Units1, s.Units2, s.Units3, s.Linearization,
+		uint8(s.M), uint8(s.M>>8)<<6|s.Tolerance&0x3f,
+		uint8(s.B), uint8(s.B>>8)<<6|uint8(s.Accuracy&0x3f),
+		uint8(s.Accuracy>>6)<<4|(s.AccuracyExp&0x3)<<2|s.Direction&0x3,
+		uint8(s.RExp)<<4|uint8(s.BExp)&0xf,
+		s.AnalogFlags, s.NominalReading, s.NormalMax, s.NormalMin,
+		s.SensorMax, s.SensorMin)
+	for t := THRESHOLD_UNR; t >= THRESHOLD_LNC; t-- {
+		data = append(data, s.Thresholds[t])
+	}
+	data = append(data, s.PosHysteresis, s.NegHysteresis, 0, 0, s.Oem)
+	data, err := s.SdrId.bytes(data)
+	if err != nil {
+		return nil, err
+	}
+	return sdrDone(data)
+}
+
+func (s *FullSensorSdr) UnmarshalBinary(data []byte) error {
+	data, err := s.SdrHeader.parse(data, SDR_FULL_SENSOR, 47)
+	if err != nil {
+		return err
+	}
+	s.SdrSensor.parse(data)
+	s.Init = data[10]
+	s.Caps = data[11]
+	s.SensorType = data[12]
+	s.EventReadingType = data[13]
+	s.AssertionMask = sdrUint16(data[14:16])
+	s.DeassertionMask = sdrUint16(data[16:18])
+	s.ReadingMask = sdrUint16(data[18:20])
+	s.Units1 = data[20]
+	s.Units2 = data[21]
+	s.Units3 = data[22]
+	s.Linearization = data[23]
+	s.M = int16(signExtend(int(data[24])|int(data[25]&0xc0)<<2, 10))
+	s.Tolerance = data[25] & 0x3f
+	s.B = int16(signExtend(int(data[26])|int(data[27]&0xc0)<<2, 10))
+	s.Accuracy = uint16(data[27]&0x3f) | uint16(data[28]>>4)<<6
+	s.AccuracyExp = data[28] >> 2 & 0x3
+	s.Direction = data[28] & 0x3
+	s.RExp = int8(signExtend(int(data[29]>>4), 4))
+	s.BExp = int8(signExtend(int(data[29]&0xf), 4))
+	s.AnalogFlags = data[30]
+	s.NominalReading = data[31]
+	s.NormalMax = data[32]
+	s.NormalMin = data[33]
+	s.SensorMax = data[34]
+	s.SensorMin = data[35]
+	for t := range s.Thresholds {
+		s.Thresholds[t] = data[41-t]
+	}
+	s.PosHysteresis = data[42]
+	s.NegHysteresis = data[43]
+	s.Oem = data[46]
+	return s.SdrId.parse(data[47:])
+}
+
+func (s *FullSensorSdr) factors() sdrFactorsT {
+	return sdrFactorsT{m: int(s.M), b: int(s.B), bExp: int(s.BExp),
+		rExp: int(s.RExp), format: s.Units1 >> 6,
+		linear: s.Linearization & 0x7f}
+}
+
+// Pick the linear conversion factors that best cover the real range
+// min to max with an unsigned raw reading.
+func (s *FullSensorSdr) SetRange(min float64, max float64) {
+	f := sdrFactorsForRange(min, max)
+	s.Units1 &^= 0xc0
+	s.Linearization = SDR_LINEAR
+	s.M, s.B = int16(f.m), int16(f.b)
+	s.RExp, s.BExp = int8(f.rExp), int8(f.bExp)
+}
+
+// Real value of a raw reading per the record's conversion factors
+func (s *FullSensorSdr) RealFromRaw(raw uint8) float64 {
+	return s.factors().toReal(raw)
+}
+
+// Raw reading closest to a real value
+func (s *FullSensorSdr) RawFromReal(value float64) uint8 {
+	return s.factors().toRaw(value)
+}
+
+// Id string instance modifiers and sharing of the compact and
+// event-only records
+type SdrSharing struct {
+	Direction            uint8
+	IdModifierType       uint8
+	ShareCount           uint8
+	EntityInstanceShared bool
+	IdModifierOffset     uint8
+}
+
+func (s *SdrSharing) bytes(data []uint8) []uint8 {
+	b := s.IdModifierOffset & 0x7f
+	if s.EntityInstanceShared {
+		b |= 0x80
+	}
+	return append(data, (s.Direction&0x3)<<6|(s.IdModifierType&0x3)<<4|
+		s.ShareCount&0xf, b)
+}
+
+func (s *SdrSharing) parse(data []uint8) {
+	s.Direction = data[0] >> 6
+	s.IdModifierType = data[0] >> 4 & 0x3
+	s.ShareCount = data[0] & 0xf
+	s.EntityInstanceShared = data[1]&0x80 != 0
+	s.IdModifierOffset = data[1] & 0x7f
+}
+
+// Type 02
+type CompactSensorSdr struct {
+	SdrHeader
+	SdrSensor
+	Init             uint8
+	Caps             uint8
+	SensorType       uint8
+	EventReadingType uint8
+	AssertionMask    uint16
+	DeassertionMask  uint16
+	ReadingMask      uint16
+	Units1           uint8
+	Units2           uint8
+	Units3           uint8
+	SdrSharing
+	PosHysteresis uint8
+	NegHysteresis uint8
+	Oem           uint8
+	SdrId
+}
+
+func (s *CompactSensorSdr) MarshalBinary() ([]byte, error) {
+	data := s.SdrHeader.bytes(SDR_COMPACT_SENSOR)
+	data = s.SdrSensor.bytes(data)
+	data = append(data, s.Init, s.Caps, s.SensorType, s.EventReadingType)
+	data = sdrAppendUint16(data, s.AssertionMask)
+	data = sdrAppendUint16(data, s.DeassertionMask)
+	data = sdrAppendUint16(data, s.ReadingMask)
+	data = append(data, s.Units1, s.Units2, s.Units3)
+	data = s.SdrSharing.bytes(data)
+	data = append(data, s.PosHysteresis, s.NegHysteresis, 0, 0, 0, s.Oem)
+	data, err := s.SdrId.bytes(data)
+	if err != nil {
+		return nil, err
+	}
+	return sdrDone(data)
+}
+
+func (s *CompactSensorSdr) UnmarshalBinary(data []byte) error {
+	data, err := s.SdrHeader.parse(data, SDR_COMPACT_SENSOR, 31)
+	if err != nil {
+		return err
+	}
+	s.SdrSensor.parse(data)
+	s.Init = data[10]
+	s.Caps = data[11]
+	s.SensorType = data[12]
+	s.EventReadingType = data[13]
+	s.AssertionMask = sdrUint16(data[14:16])
+	s.DeassertionMask = sdrUint16(data[16:18])
+	s.ReadingMask = sdrUint16(data[18:20])
+	s.Units1 = data[20]
+	s.Units2 = data[21]
+	s.Units3 = data[22]
+	s.SdrSharing.parse(data[23:25])
+	s.PosHysteresis = data[25]
+	s.NegHysteresis = data[26]
+	s.Oem = data[30]
+	return s.SdrId.parse(data[31:])
+}
+
+// Type 03
+type EventOnlySdr struct {
+	SdrHeader
+	SdrSensor
+	SensorType       uint8
+	EventReadingType uint8
+	SdrSharing
+	Oem uint8
+	SdrId
+}
+
+func (s *EventOnlySdr) MarshalBinary() ([]byte, error) {
+	data := s.SdrHeader.bytes(SDR_EVENT_ONLY)
+	data = s.SdrSensor.bytes(data)
+	data = append(data, s.SensorType, s.EventReadingType)
+	data = s.SdrSharing.bytes(data)
+	data = append(data, 0, s.Oem)
+	data, err := s.SdrId.bytes(data)
+	if err != nil {
+		return nil, err
+	}
+	return sdrDone(data)
+}
+
+func (s *EventOnlySdr) UnmarshalBinary(data []byte) error {
+	data, err := s.SdrHeader.parse(data, SDR_EVENT_ONLY, 16)
+	if err != nil {
+		return err
+	}
+	s.SdrSensor.parse(data)
+	s.SensorType = data[10]
+	s.EventReadingType = data[11]
+	s.SdrSharing.parse(data[12:14])
+	s.Oem = data[15]
+	return s.SdrId.parse(data[16:])
+}
+
+// Contained entity, or the ends of a range of them
+type SdrEntity struct {
+	Id       uint8
+	Instance uint8
+}
+
+// Entity association flags (byte 7)
+const (
+	SDR_ASSOC_RANGE      = 0x80
+	SDR_ASSOC_LINKED     = 0x40
+	SDR_ASSOC_ACCESSIBLE = 0x20
+)
+
+// Type 08
+type EntityAssocSdr struct {
+	SdrHeader
+	Container SdrEntity
+	Flags     uint8
+	Contained [4]SdrEntity
+}
+
+func (s *EntityAssocSdr) MarshalBinary() ([]byte, error) {
+	data := s.SdrHeader.bytes(SDR_ENTITY_ASSOCIATION)
+	data = append(data, s.Container.Id, s.Container.Instance, s.Flags)
+	for _, e := range s.Contained {
+		data = append(data, e.Id, e.Instance)
+	}
+	return sdrDone(data)
+}
+
+func (s *EntityAssocSdr) UnmarshalBinary(data []byte) error {
+	data, err := s.SdrHeader.parse(data, SDR_ENTITY_ASSOCIATION, 16)
+	if err != nil {
+		return err
+	}
+	s.Container = SdrEntity{data[5], data[6]}
+	s.Flags = data[7]
+	for i := range s.Contained {
+		s.Contained[i] = SdrEntity{data[8+2*i], data[9+2*i]}
+	}
+	return nil
+}
+
+// Contained entity of a device-relative association
+type SdrDevEntity struct {
+	Addr    uint8
+	Channel uint8
+	SdrEntity
+}
+
+// Type 09
+type DevEntityAssocSdr struct {
+	SdrHeader
+	Container        SdrEntity
+	ContainerAddr    uint8
+	ContainerChannel uint8
+	Flags            uint8
+	Contained        [4]SdrDevEntity
+}
+
+func (s *DevEntityAssocSdr) MarshalBinary() ([]byte, error) {
+	data := s.SdrHeader.bytes(SDR_DEV_ENTITY_ASSOCIATION)
+	data = append(data, s.Container.Id, s.Container.Instance,
+		s.ContainerAddr, s.ContainerChannel, s.Flags)
+	for _, e := range s.Contained {
+		data = append(data, e.Addr, e.Channel, e.Id, e.Instance)
+	}
+	return sdrDone(data)
+}
+
+func (s *DevEntityAssocSdr) UnmarshalBinary(data []byte) error {
+	data, err := s.SdrHeader.parse(data, SDR_DEV_ENTITY_ASSOCIATION, 26)
+	if err != nil {
+		return err
+	}
+	s.Container = SdrEntity{data[5], data[6]}
+	s.ContainerAddr = data[7]
+	s.ContainerChannel = data[8]
+	s.Flags = data[9]
+	for i := range s.Contained {
+		d := data[10+4*i:]
+		s.Contained[i] = SdrDevEntity{d[0], d[1], SdrEntity{d[2], d[3]}}
+	}
+	return nil
+}
+
+// Entity, oem byte and id that end every locator record
+type SdrLocator struct {
+	Entity SdrEntity
+	Oem    uint8
+	SdrId
+}
+
+func (s *SdrLocator) bytes(data []uint8) ([]uint8, error) {
+	data = append(data, s.Entity.Id, s.Entity.Instance, s.Oem)
+	return s.SdrId.bytes(data)
+}
+
+func (s *SdrLocator) parse(data []uint8) error {
+	s.Entity = SdrEntity{data[12], data[13]}
+	s.Oem = data[14]
+	return s.SdrId.parse(data[15:])
+}
+
+// Type 10
+type GenericLocatorSdr struct {
+	SdrHeader
+	AccessAddr         uint8
+	SlaveAddr          uint8
+	AccessLunBus       uint8
+	AddrSpan           uint8
+	DeviceType         uint8
+	DeviceTypeModifier uint8
+	SdrLocator
+}
+
+func (s *GenericLocatorSdr) MarshalBinary() ([]byte, error) {
+	data := s.SdrHeader.bytes(SDR_GENERIC_DEV_LOCATOR)
+	data = append(data, s.AccessAddr, s.SlaveAddr, s.AccessLunBus,
+		s.AddrSpan, 0, s.DeviceType, s.DeviceTypeModifier)
+	data, err := s.SdrLocator.bytes(data)
+	if err != nil {
+		return nil, err
+	}
+	return sdrDone(data)
+}
+
+func (s *GenericLocatorSdr) UnmarshalBinary(data []byte) error {
+	data, err := s.SdrHeader.parse(data, SDR_GENERIC_DEV_LOCATOR, 15)
+	if err != nil {
+		return err
+	}
+	s.AccessAddr = data[5]
+	s.SlaveAddr = data[6]
+	s.AccessLunBus = data[7]
+	s.AddrSpan = data[8]
+	s.DeviceType = data[10]
+	s.DeviceTypeModifier = data[11]
+	return s.SdrLocator.parse(data)
+}
+
+// Type 11
+type FruLocatorSdr struct {
+	SdrHeader
+	AccessAddr         uint8
+	FruId              uint8
+	AccessLunBus       uint8 // logical device bit 7, lun 4:3, bus 2:0
+	Channel            uint8 // bits 7:4
+	DeviceType         uint8
+	DeviceTypeModifier uint8
+	SdrLocator
+}
+
+func (s *FruLocatorSdr) MarshalBinary() ([]byte, error) {
+	data := s.SdrHeader.bytes(SDR_FRU_DEV_LOCATOR)
+	data = append(data, s.AccessAddr, s.FruId, s.AccessLunBus,
+		s.Channel, 0, s.DeviceType, s.DeviceTypeModifier)
+	data, err := s.SdrLocator.bytes(data)
+	if err != nil {
+		return nil, err
+	}
+	return sdrDone(data)
+}
+
+func (s *FruLocatorSdr) UnmarshalBinary(data []byte) error {
+	data, err := s.SdrHeader.parse(data, SDR_FRU_DEV_LOCATOR, 15)
+	if err != nil {
+		return err
+	}
+	s.AccessAddr = data[5]
+	s.FruId = data[6]
+	s.AccessLunBus = data[7]
+	s.Channel = data[8]
+	s.DeviceType = data[10]
+	s.DeviceTypeModifier = data[11]
+	return s.SdrLocator.parse(data)
+}
+
+// Type 12
+type McLocatorSdr struct {
+	SdrHeader
+	SlaveAddr      uint8
+	Channel        uint8
+	PowerStateInit uint8
+	Capabilities   uint8
+	SdrLocator
+}
+
+func (s *McLocatorSdr) MarshalBinary() ([]byte, error) {
+	data := s.SdrHeader.bytes(SDR_MC_DEV_LOCATOR)
+	data = append(data, s.SlaveAddr, s.Channel, s.PowerStateInit,
+		s.Capabilities, 0, 0, 0)
+	data, err := s.SdrLocator.bytes(data)
+	if err != nil {
+		return nil, err
+	}
+	return sdrDone(data)
+}
+
+func (s *McLocatorSdr) UnmarshalBinary(data []byte) error {
+	data, err := s.SdrHeader.parse(data, SDR_MC_DEV_LOCATOR, 15)
+	if err != nil {
+		return err
+	}
+	s.SlaveAddr = data[5]
+	s.Channel = data[6]
+	s.PowerStateInit = data[7]
+	s.Capabilities = data[8]
+	return s.SdrLocator.parse(data)
+}
+
+// Type C0
+type OemSdr struct {
+	SdrHeader
+	MfgId [3]uint8
+	Data  []uint8
+}
+
+func (s *OemSdr) MarshalBinary() ([]byte, error) {
+	data := s.SdrHeader.bytes(SDR_OEM)
+	data = append(data, s.MfgId[:]...)
+	data = append(data, s.Data...)
+	return sdrDone(data)
+}
+
+func (s *OemSdr) UnmarshalBinary(data []byte) error {
+	data, err := s.SdrHeader.parse(data, SDR_OEM, 8)
+	if err != nil {
+		return err
+	}
+	copy(s.MfgId[:], data[5:8])
+	s.Data = append([]uint8(nil), data[8:]...)
+	return nil
+}
+
+// Any other record type, kept as its body bytes
+type RawSdr struct {
+	SdrHeader
+	Body []uint8
+}
+
+func (s *RawSdr) MarshalBinary() ([]byte, error) {
+	data := s.SdrHeader.bytes(s.RecordType)
+	data = append(data, s.Body...)
+	return sdrDone(data)
+}
+
+func (s *RawSdr) UnmarshalBinary(data []byte) error {
+	if len(data) < 5 {
+		return errSdrLength
+	}
+	data, err := s.SdrHeader.parse(data, data[3], 5)
+	if err != nil {
+		return err
+	}
+	s.Body = append([]uint8(nil), data[5:]...)
+	return nil
+}
+
+// Decode a record, as returned by get sdr, into its typed form
+func UnmarshalSdr(data []uint8) (Sdr, error) {
+	var s Sdr
+
+	if len(data) < 5 {
+		return nil, errSdrLength
+	}
+	switch data[3] {
+	case SDR_FULL_SENSOR:
+		s = new(FullSensorSdr)
+	case SDR_COMPACT_SENSOR:
+		s = new(CompactSensorSdr)
+	case SDR_EVENT_ONLY:
+		s = new(EventOnlySdr)
+	case SDR_ENTITY_ASSOCIATION:
+		s = new(EntityAssocSdr)
+	case SDR_DEV_ENTITY_ASSOCIATION:
+		s = new(DevEntityAssocSdr)
+	case SDR_GENERIC_DEV_LOCATOR:
+		s = new(GenericLocatorSdr)
+	case SDR_FRU_DEV_LOCATOR:
+		s = new(FruLocatorSdr)
+	case SDR_MC_DEV_LOCATOR:
+		s = new(McLocatorSdr)
+	case SDR_OEM:
+		s = new(OemSdr)
+	default:
+		s = new(RawSdr)
+	}
+	err := s.UnmarshalBinary(data)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
@@ -0,0 +1,181 @@
+// Copyright 2015 Platina Systems, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style license described in the
+// LICENSE file.
+
+// Package contains IPMI 2.0 spec implementation
+package ipmigod
+
+import (
+	"encoding/hex"
+	"reflect"
+	"testing"
+)
+
+func TestSdrMarshalUnmarshal(t *testing.T) {
+	sensor := SdrSensor{OwnerId: 0x22, OwnerLun: 0x13, Number: 0x45,
+		EntityId: 0x0a, EntityInstance: 2}
+	sharing := SdrSharing{Direction: 2, IdModifierType: 1, ShareCount: 4,
+		EntityInstanceShared: true, IdModifierOffset: 0x31}
+	locator := SdrLocator{Entity: SdrEntity{0x07, 1}, Oem: 0x99,
+		SdrId: sdrId("1locator")}
+
+	for _, record := range []Sdr{
+		&FullSensorSdr{SdrHeader: SdrHeader{RecordId: 0x1234},
+			SdrSensor: sensor, Init: 0x7f, Caps: 0x68,
+			SensorType: 1, EventReadingType: 1,
+			AssertionMask: 0x7a95, DeassertionMask: 0x7a95,
+			ReadingMask: 0x3f3f, Units1: 0x80, Units2: 1, Units3: 2,
+			Linearization: 7, M: -300, Tolerance: 0x2a, B: 200,
+			Accuracy: 700, AccuracyExp: 2, Direction: 1, RExp: -3,
+			BExp: 5, AnalogFlags: 7, NominalReading: 0x60,
+			NormalMax: 0xb0, NormalMin: 0x10, SensorMax: 0xff,
+			SensorMin:     1,
+			Thresholds:    [NUM_THRESHOLDS]uint8{1, 2, 3, 4, 5, 6},
+			PosHysteresis: 2, NegHysteresis: 3, Oem: 0x55,
+			SdrId: sdrId("1temperature")},
+		&CompactSensorSdr{SdrSensor: sensor, Init: 0x63, Caps: 0x40,
+			SensorType: 0x08, EventReadingType: 0x6f,
+			AssertionMask: 0x0b, DeassertionMask: 0x0b,
+			ReadingMask: 0x0b, Units1: 0xc0, SdrSharing: sharing,
+			PosHysteresis: 1, NegHysteresis: 1, Oem: 0x12,
+			SdrId: SdrId{SDR_ID_BCD_PLUS, "12-34.5"}},
+		&EventOnlySdr{SdrSensor: sensor, SensorType: 0x25,
+			EventReadingType: 0x6f, SdrSharing: sharing, Oem: 3,
+			SdrId: SdrId{SDR_ID_6BIT_ASCII, "CARD PRESENT"}},
+		&EntityAssocSdr{Container: SdrEntity{0x17, 1},
+			Flags:     SDR_ASSOC_RANGE,
+			Contained: [4]SdrEntity{{0x0a, 1}, {0x0a, 4}}},
+		&DevEntityAssocSdr{Container: SdrEntity{0x17, 1},
+			ContainerAddr: 0x20, ContainerChannel: 0x10,
+			Flags: SDR_ASSOC_LINKED,
+			Contained: [4]SdrDevEntity{{0x22, 0, SdrEntity{0x0b, 1}},
+				{0x24, 0, SdrEntity{0x0b, 2}}}},
+		&GenericLocatorSdr{AccessAddr: 0x20, SlaveAddr: 0x90,
+			AccessLunBus: 0x02, AddrSpan: 1, DeviceType: 0x08,
+			DeviceTypeModifier: 1, SdrLocator: locator},
+		&FruLocatorSdr{AccessAddr: 0x20, FruId: 1, AccessLunBus: 0x80,
+			Channel: 0x10, DeviceType: 0x10, DeviceTypeModifier: 0,
+			SdrLocator: locator},
+		&McLocatorSdr{SlaveAddr: 0x20, Channel: 0, PowerStateInit: 0,
+			Capabilities: 0xbf, SdrLocator: locator},
+		&OemSdr{MfgId: [3]uint8{0x1b, 0xbe, 0}, Data: []uint8{1, 2, 3}},
+		&RawSdr{SdrHeader: SdrHeader{RecordType: 0x13},
+			Body: []uint8{0xde, 0xad}},
+	} {
+		data, err := record.MarshalBinary()
+		if err != nil {
+			t.Errorf("%T: marshal: %v", record, err)
+			continue
+		}
+		if int(data[4])+5 != len(data) {
+			t.Errorf("%T: length byte %d for %d bytes", record,
+				data[4], len(data))
+		}
+		decoded, err := UnmarshalSdr(data)
+		if err != nil {
+			t.Errorf("%T: unmarshal: %v", record, err)
+			continue
+		}
+		if !reflect.DeepEqual(decoded, record) {
+			t.Errorf("%T: got %+v, want %+v", record, decoded,
+				record)
+		}
+	}
+}
+
+func TestSdrIdEncodeDecode(t *testing.T) {
+	for _, c := range []struct {
+		idType  uint8
+		id      string
+		decoded string // if not id
+		encoded string
+	}{
+		{SDR_ID_8BIT_ASCII, "0DJtemp", "", "c730444a74656d70"},
+		{SDR_ID_UNICODE, "ab", "", "026162"},
+		{SDR_ID_8BIT_ASCII, "", "", "c0"},
+		{SDR_ID_8BIT_ASCII, "0123456789abcdefXYZ", "0123456789abcdef",
+			"d030313233343536373839616263646566"},
+		// High nibble first, odd lengths padded with a space
+		{SDR_ID_BCD_PLUS, "12-34.5", "", "4412b34c5a"},
+		// Low bits first, upper case only
+		{SDR_ID_6BIT_ASCII, "ipmi", "IPMI", "8329dca6"},
+		{SDR_ID_6BIT_ASCII, "PSU 1", "", "84f05c0311"},
+	} {
+		data, err := SdrIdEncode(c.idType, c.id)
+		if err != nil {
+			t.Errorf("%q: encode: %v", c.id, err)
+			continue
+		}
+		if hex.EncodeToString(data) != c.encoded {
+			t.Errorf("%q: encoded %x, want %s", c.id, data,
+				c.encoded)
+		}
+		idType, id, err := SdrIdDecode(data)
+		want := c.decoded
+		if want == "" {
+			want = c.id
+		}
+		if err != nil || idType != c.idType || id != want {
+			t.Errorf("%q: decoded %d %q %v", c.id, idType, id, err)
+		}
+	}
+
+	for _, c := range []struct {
+		idType uint8
+		id     string
+	}{
+		{SDR_ID_BCD_PLUS, "12a"},
+		{SDR_ID_6BIT_ASCII, "a~b"},
+		{4, "x"},
+	} {
+		if _, err := SdrIdEncode(c.idType, c.id); err == nil {
+			t.Errorf("%d %q: encoded", c.idType, c.id)
+		}
+	}
+	if _, _, err := SdrIdDecode([]uint8{0xc4, 'a'}); err == nil {
+		t.Errorf("short id decoded")
+	}
+}
+
+// The length byte can't describe more than 255 bytes of record
+func TestSdrTooLong(t *testing.T) {
+	record := &OemSdr{Data: make([]uint8, 0xff-3)}
+	data, err := record.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data[4] != 0xff {
+		t.Errorf("longest record length %d", data[4])
+	}
+	record.Data = append(record.Data, 0)
+	if _, err = record.MarshalBinary(); err == nil {
+		t.Errorf("record of %d bytes marshalled", 5+3+len(record.Data))
+	}
+}
+
+// The fixed sensors must come out as they did when their records were
+// built by hand, record ids aside.
+func TestFixedSensorSdrs(t *testing.T) {
+	mcTestReset(t)
+	fixedSensorsAdd()
+
+	for i, want := range []string{
+		"5101322000010300678801010fc07fc03838000100000100000000000360" +
+			"b000b000a090660000000000000000c730444a74656d70",
+		"5101352000020300678802010fc07fc03838000400000100000000000300" +
+			"000d100c0f0e0d0000000000000000ca304d58766f6c74616765",
+		"5101352000030300678803010fc07fc03838000500000100000000000300" +
+			"000306050706050000000000000000ca304d5863757272656e74",
+		"5101352000040300678804010fc07fc0383804120a000100000000000300" +
+			"00285032463c000000000000000000ca30465866616e72656164",
+	} {
+		entry := sdrFind(0, uint8(i+1))
+		if entry == nil {
+			t.Fatalf("sensor %d: no sdr", i+1)
+		}
+		got := hex.EncodeToString(entry.data[2:entry.length])
+		if got != want {
+			t.Errorf("sensor %d:\n got %s\nwant %s", i+1, got, want)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+// Copyright 2015 Platina Systems, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style license described in the
+// LICENSE file.
+
+// Package contains IPMI 2.0 spec implementation
+package ipmigod
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Simulated readings can be scripted in place of the random ones.
+//
+// SimDir is a directory with one file per sensor, named by the
+// sensor's sdr id string (e.g. "0DJtemp") or its sensor number,
+// holding the current real value (e.g. "85.5"). A non-linear sensor
+// also takes its reading factors from "<name>.factors", lines of
+// "start-raw M B Bexp Rexp".
+//
+// SimTimeline is a csv file of "seconds,sensor,value" lines, sensor
+// again being an id string or number. Each value takes effect that
+// many seconds after startup and holds until the sensor's next line.
+// With SimTimelineLoop the timeline restarts after its last line.
+//
+// They are set by the program running ipmigod before calling Ipmigod.
+var (
+	SimDir          string = ""
+	SimTimeline     string = ""
+	SimTimelineLoop bool   = false
+)
+
+// Returned by a source that has no reading for the sensor (yet)
+var errNoReading = errors.New("no reading")
+
+// Reads the sensor value from a file
+type simFileSourceT struct {
+	path string
+}
+
+func (s *simFileSourceT) read() (float64, error) {
+	v, err := readSysfsString(s.path)
+	if os.IsNotExist(err) {
+		return 0, errNoReading
+	} else if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(v, 64)
+}
+
+type simEventT struct {
+	at    float64 // seconds since start
+	value float64
+}
+
+type simTimelineT struct {
+	start  time.Time
+	length float64
+	events map[string][]simEventT
+}
+
+// Replays the sensor's values from a timeline
+type simTimelineSourceT struct {
+	tl  *simTimelineT
+	key string
+}
+
+func (s *simTimelineSourceT) read() (float64, error) {
+	events := s.tl.events[s.key]
+
+	t := time.Since(s.tl.start).Seconds()
+	if SimTimelineLoop && s.tl.length > 0 {
+		t = math.Mod(t, s.tl.length)
+	}
+	i := sort.Search(len(events), func(i int) bool {
+		return events[i].at > t
+	}) - 1
+	if i < 0 {
+		return 0, errNoReading
+	}
+	return events[i].value, nil
+}
+
+func simTimelineLoad(path string) (*simTimelineT, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tl := &simTimelineT{events: make(map[string][]simEventT)}
+	r := csv.NewReader(f)
+	r.Comment = '#'
+	r.FieldsPerRecord = 3
+	r.TrimLeadingSpace = true
+	for {
+		rec, err := r.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		at, err := strconv.ParseFloat(rec[0], 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s: bad time %q", path, rec[0])
+		}
+		value, err := strconv.ParseFloat(rec[2], 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s: bad value %q", path, rec[2])
+		}
+		key := strings.TrimSpace(rec[1])
+		tl.events[key] = append(tl.events[key],
+			simEventT{at: at, value: value})
+		if at > tl.length {
+			tl.length = at
+		}
+	}
+
+	for key := range tl.events {
+		events := tl.events[key]
+		sort.SliceStable(events, func(i, j int) bool {
+			return events[i].at < events[j].at
+		})
+	}
+	tl.start = time.Now()
+	return tl, nil
+}
+
+// Sdr id string of a record, empty if its type has none
+func sdrIdString(sdr *sdrT) string {
+	off := sdrIdOffset(sdr)
+	if off == 0 || off >= int(sdr.length) {
+		return ""
+	}
+	_, id, _ := SdrIdDecode(sdr.data[off:sdr.length])
+	return id
+}
+
+// Attach scripted sources to the simulated sensors
+func simSourcesAttach() {
+	var tl *simTimelineT
+
+	if SimTimeline != "" {
+		var err error
+		tl, err = simTimelineLoad(SimTimeline)
+		if err != nil {
+			fmt.Println("simSourcesAttach:", err)
+			tl = nil
+		}
+	}
+	if SimDir == "" && tl == nil {
+		return
+	}
+
+	for entry := mc.mainSdrs.sdrs; entry != nil; entry = entry.next {
+		sensor := mc.sensors[entry.lun][entry.sensNum]
+		if sensor == nil {
+			continue
+		}
+		id := sdrIdString(entry)
+		num := strconv.Itoa(int(entry.sensNum))
+		if tl != nil {
+			for _, key := range []string{id, num} {
+				if _, ok := tl.events[key]; ok {
+					sensor.source =
+						&simTimelineSourceT{tl: tl, key: key}
+					break
+				}
+			}
+		}
+		if sensor.source == nil && SimDir != "" {
+			path := filepath.Join(SimDir, id)
+			if _, err := os.Stat(path); err != nil {
+				path = filepath.Join(SimDir, num)
+			}
+			sensor.source = &simFileSourceT{path: path}
+		}
+		if SimDir != "" && sdrNonLinear(entry) {
+			path := filepath.Join(SimDir, id+".factors")
+			if _, err := os.Stat(path); err != nil {
+				path = filepath.Join(SimDir, num+".factors")
+			}
+			if t, err := sdrFactorsTableLoad(path); err == nil {
+				sensor.factors = t
+			} else if !os.IsNotExist(err) {
+				fmt.Println("simSourcesAttach:", err)
+			}
+		}
+	}
+}
+
+// Load a table of reading factors, one "start-raw M B Bexp Rexp" line
+// per range of raw readings.
+func sdrFactorsTableLoad(path string) (sdrFactorsTableT, error) {
+	var t sdrFactorsTableT
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	for n, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 5 {
+			return nil, fmt.Errorf("%s:%d: want 5 fields", path,
+				n+1)
+		}
+		var v [5]int
+		for i, field := range fields {
+			v[i], err = strconv.Atoi(field)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", path, n+1,
+					err)
+			}
+		}
+		if v[0] < 0 || v[0] > 255 {
+			return nil, fmt.Errorf("%s:%d: bad raw reading",
+				path, n+1)
+		}
+		t = append(t, sdrFactorsRangeT{start: uint8(v[0]),
+			factors: sdrFactorsT{m: v[1], b: v[2], bExp: v[3],
+				rExp: v[4]}})
+	}
+	sort.Slice(t, func(i, j int) bool { return t[i].start < t[j].start })
+	return t, nil
+}